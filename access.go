@@ -0,0 +1,189 @@
+package datum
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Capability int
+
+const (
+	CapRead Capability = iota
+	CapWrite
+	CapAdmin
+)
+
+// Capabilities are the rights carried by an access token. Spaces and
+// Prefixes, when set, limit the token to those spaces and to keys under
+// those dotted prefixes.
+type Capabilities struct {
+	Read  bool
+	Write bool
+	Admin bool
+
+	Spaces   []string
+	Prefixes []string
+}
+
+// FullCapabilities are the rights of a token that owns its data.
+var FullCapabilities = &Capabilities{Read: true, Write: true, Admin: true}
+
+func (c *Capabilities) Has(cap Capability) bool {
+	switch cap {
+	case CapRead:
+		return c.Read
+	case CapWrite:
+		return c.Write
+	case CapAdmin:
+		return c.Admin
+	}
+
+	return false
+}
+
+func (c *Capabilities) Restricted() bool {
+	return len(c.Spaces) > 0 || len(c.Prefixes) > 0
+}
+
+// Allows reports if cap may be used on key in space. An empty key means
+// the whole space, which a prefix limited token can't touch.
+func (c *Capabilities) Allows(cap Capability, space, key string) bool {
+	if !c.Has(cap) {
+		return false
+	}
+
+	if len(c.Spaces) > 0 && !contains(c.Spaces, space) {
+		return false
+	}
+
+	if len(c.Prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range c.Prefixes {
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Within returns c limited to what parent grants. Unset limits are
+// inherited from parent. If c asks for a space or prefix outside of
+// parent's limits, false is returned.
+func (c *Capabilities) Within(parent *Capabilities) (*Capabilities, bool) {
+	out := &Capabilities{
+		Read:  c.Read && parent.Read,
+		Write: c.Write && parent.Write,
+		Admin: c.Admin && parent.Admin,
+	}
+
+	var ok bool
+
+	out.Spaces, ok = narrow(c.Spaces, parent.Spaces, func(s, p string) bool {
+		return s == p
+	})
+
+	if !ok {
+		return nil, false
+	}
+
+	out.Prefixes, ok = narrow(c.Prefixes, parent.Prefixes, func(s, p string) bool {
+		return s == p || strings.HasPrefix(s, p+".")
+	})
+
+	if !ok {
+		return nil, false
+	}
+
+	return out, true
+}
+
+func narrow(vals, limits []string, within func(val, limit string) bool) ([]string, bool) {
+	if len(limits) == 0 {
+		return vals, true
+	}
+
+	if len(vals) == 0 {
+		return limits, true
+	}
+
+outer:
+	for _, v := range vals {
+		for _, l := range limits {
+			if within(v, l) {
+				continue outer
+			}
+		}
+
+		return nil, false
+	}
+
+	return vals, true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessEntry is how an access token is stored in the "_" token's
+// "access" space.
+func accessEntry(parent string, caps *Capabilities) map[string]interface{} {
+	return map[string]interface{}{
+		"parent":   parent,
+		"read":     caps.Read,
+		"write":    caps.Write,
+		"admin":    caps.Admin,
+		"spaces":   caps.Spaces,
+		"prefixes": caps.Prefixes,
+	}
+}
+
+func parseAccessEntry(val interface{}) (string, *Capabilities, error) {
+	entry, ok := val.(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("corrupt access entry")
+	}
+
+	parent, ok := entry["parent"].(string)
+	if !ok {
+		return "", nil, fmt.Errorf("corrupt access entry")
+	}
+
+	caps := &Capabilities{}
+
+	caps.Read, _ = entry["read"].(bool)
+	caps.Write, _ = entry["write"].(bool)
+	caps.Admin, _ = entry["admin"].(bool)
+
+	caps.Spaces = stringList(entry["spaces"])
+	caps.Prefixes = stringList(entry["prefixes"])
+
+	return parent, caps, nil
+}
+
+func stringList(val interface{}) []string {
+	switch list := val.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		var out []string
+
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				out = append(out, s)
+			}
+		}
+
+		return out
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package datum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestCapabilities(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("allows everything with full capabilities", func() {
+		assert.True(t, FullCapabilities.Allows(CapRead, "def", ""))
+		assert.True(t, FullCapabilities.Allows(CapWrite, "def", "blah.bar"))
+		assert.True(t, FullCapabilities.Allows(CapAdmin, "other", "blah"))
+	})
+
+	n.It("only allows the granted rights", func() {
+		caps := &Capabilities{Read: true}
+
+		assert.True(t, caps.Allows(CapRead, "def", "blah"))
+		assert.False(t, caps.Allows(CapWrite, "def", "blah"))
+		assert.False(t, caps.Allows(CapAdmin, "def", "blah"))
+	})
+
+	n.It("limits access to certain spaces", func() {
+		caps := &Capabilities{Read: true, Spaces: []string{"def"}}
+
+		assert.True(t, caps.Allows(CapRead, "def", "blah"))
+		assert.False(t, caps.Allows(CapRead, "other", "blah"))
+	})
+
+	n.It("limits access to keys under certain prefixes", func() {
+		caps := &Capabilities{Read: true, Prefixes: []string{"db"}}
+
+		assert.True(t, caps.Allows(CapRead, "def", "db"))
+		assert.True(t, caps.Allows(CapRead, "def", "db.host"))
+		assert.False(t, caps.Allows(CapRead, "def", "dbx"))
+		assert.False(t, caps.Allows(CapRead, "def", ""))
+	})
+
+	n.It("narrows capabilities to those of a parent", func() {
+		parent := &Capabilities{Read: true, Admin: true, Prefixes: []string{"db"}}
+		want := &Capabilities{Read: true, Write: true, Prefixes: []string{"db.host"}}
+
+		caps, ok := want.Within(parent)
+		assert.True(t, ok)
+
+		assert.True(t, caps.Read)
+		assert.False(t, caps.Write)
+		assert.False(t, caps.Admin)
+		assert.Equal(t, []string{"db.host"}, caps.Prefixes)
+	})
+
+	n.It("inherits the limits of a parent", func() {
+		parent := &Capabilities{Read: true, Spaces: []string{"def"}}
+		want := &Capabilities{Read: true}
+
+		caps, ok := want.Within(parent)
+		assert.True(t, ok)
+
+		assert.Equal(t, []string{"def"}, caps.Spaces)
+	})
+
+	n.It("refuses limits outside those of a parent", func() {
+		parent := &Capabilities{Read: true, Spaces: []string{"def"}}
+		want := &Capabilities{Read: true, Spaces: []string{"other"}}
+
+		_, ok := want.Within(parent)
+		assert.False(t, ok)
+	})
+
+	n.Meow()
+}
+
+func TestAccessRevocation(t *testing.T) {
+	n := neko.Start(t)
+
+	var (
+		be *MsgpackBackend
+		h  *HTTPApi
+	)
+
+	n.Setup(func() {
+		be = NewMsgpackBackend(NewMemoryStore())
+		h = NewHTTPApi(UUIDTokenGen(), be)
+
+		require.NoError(t, be.Set("aabbcc", "def", "name", "vektra"))
+	})
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	mint := func(path string) string {
+		w := do("POST", path)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	n.It("revokes the tokens an access token made along with it", func() {
+		child := mint("/create/access/aabbcc?cap=read&cap=admin")
+		grandchild := mint("/create/access/" + child + "?cap=read&cap=admin")
+		greatGrandchild := mint("/create/access/" + grandchild + "?cap=read")
+		view := mint("/create/view/" + grandchild)
+
+		for _, token := range []string{grandchild, greatGrandchild, view} {
+			assert.Equal(t, 200, do("GET", "/"+token+"/~def/name").Code)
+		}
+
+		assert.Equal(t, 200, do("DELETE", "/_access/aabbcc/"+child).Code)
+
+		for _, token := range []string{child, grandchild, greatGrandchild} {
+			assert.Equal(t, 403, do("GET", "/"+token+"/~def/name").Code)
+		}
+
+		owner, err := be.Get("_", "views", view)
+		require.NoError(t, err)
+		assert.Nil(t, owner)
+
+		access, err := be.Get("_", "accesslist", "aabbcc")
+		require.NoError(t, err)
+		assert.Nil(t, access)
+
+		minted, err := be.Get("_", "minted", "")
+		require.NoError(t, err)
+		assert.Empty(t, minted)
+	})
+
+	n.It("leaves the tokens of other access tokens alone", func() {
+		child := mint("/create/access/aabbcc?cap=read&cap=admin")
+		other := mint("/create/access/aabbcc?cap=read&cap=admin")
+		grandchild := mint("/create/access/" + other + "?cap=read")
+
+		assert.Equal(t, 200, do("DELETE", "/_access/aabbcc/"+child).Code)
+
+		assert.Equal(t, 200, do("GET", "/"+grandchild+"/~def/name").Code)
+	})
+
+	n.Meow()
+}
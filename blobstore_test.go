@@ -0,0 +1,236 @@
+package datum
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+// testBlobStore adds the behavior every BlobStore must have to n. store
+// returns the store under test, which must be empty for each spec.
+func testBlobStore(t *testing.T, n *neko.Organ, store func() BlobStore) {
+	n.It("returns blobs that were set", func() {
+		err := store().Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		data, err := store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+	})
+
+	n.It("replaces blobs that were set", func() {
+		err := store().Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		err = store().Set("aabbcc", "default", []byte("bar"))
+		require.NoError(t, err)
+
+		data, err := store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("bar"), data)
+	})
+
+	n.It("returns nil for missing blobs", func() {
+		data, err := store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Nil(t, data)
+
+		err = store().Set("aabbcc", "other", []byte("foo"))
+		require.NoError(t, err)
+
+		data, err = store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Nil(t, data)
+	})
+
+	n.It("keeps the spaces of tokens apart", func() {
+		err := store().Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		err = store().Set("ddeeff", "default", []byte("bar"))
+		require.NoError(t, err)
+
+		data, err := store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+	})
+
+	n.It("lists the spaces of a token", func() {
+		for _, space := range []string{"default", "other", ".index.default"} {
+			err := store().Set("aabbcc", space, []byte("foo"))
+			require.NoError(t, err)
+		}
+
+		err := store().Set("ddeeff", "third", []byte("bar"))
+		require.NoError(t, err)
+
+		spaces, err := store().List("aabbcc")
+		require.NoError(t, err)
+
+		sort.Strings(spaces)
+
+		assert.Equal(t, []string{".index.default", "default", "other"}, spaces)
+
+		spaces, err = store().List("gghhii")
+		require.NoError(t, err)
+
+		assert.Empty(t, spaces)
+	})
+
+	n.It("deletes blobs", func() {
+		err := store().Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		err = store().Set("aabbcc", "other", []byte("bar"))
+		require.NoError(t, err)
+
+		err = store().Delete("aabbcc", "default")
+		require.NoError(t, err)
+
+		data, err := store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Nil(t, data)
+
+		spaces, err := store().List("aabbcc")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"other"}, spaces)
+
+		err = store().Delete("aabbcc", "default")
+		require.NoError(t, err)
+
+		err = store().Delete("gghhii", "default")
+		require.NoError(t, err)
+	})
+
+	n.It("only sets blobs that haven't changed", func() {
+		ok, err := store().CompareAndSet("aabbcc", "default", nil, []byte("foo"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = store().CompareAndSet("aabbcc", "default", nil, []byte("bar"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = store().CompareAndSet("aabbcc", "default", []byte("bar"), []byte("qux"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = store().CompareAndSet("aabbcc", "default", []byte("foo"), []byte("bar"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		data, err := store().Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("bar"), data)
+	})
+
+	n.It("only sets batches whose blobs haven't changed", func() {
+		batch, ok := store().(BatchStore)
+		if !ok {
+			return
+		}
+
+		err := store().Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		blobs := map[string][]byte{
+			"default": []byte("bar"),
+			"other":   []byte("qux"),
+		}
+
+		ok, err = batch.CompareAndSetBatch("aabbcc", map[string][]byte{"default": nil}, blobs)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = batch.CompareAndSetBatch("aabbcc", map[string][]byte{"default": []byte("foo"), "other": []byte("foo")}, blobs)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		data, err := store().Get("aabbcc", "other")
+		require.NoError(t, err)
+		assert.Nil(t, data)
+
+		ok, err = batch.CompareAndSetBatch("aabbcc", map[string][]byte{"default": []byte("foo"), "other": nil}, blobs)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		data, err = store().Get("aabbcc", "default")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), data)
+
+		data, err = store().Get("aabbcc", "other")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("qux"), data)
+	})
+
+	n.It("loses no writes when backends share it", func() {
+		const keys = 10
+
+		var wg sync.WaitGroup
+
+		// Each backend only serializes its own writes, as with datumd
+		// instances sharing a store.
+		for i := 0; i < 2; i++ {
+			mp := NewMsgpackBackend(store())
+
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < keys; j++ {
+					err := mp.Set("aabbcc", "default", fmt.Sprintf("w%d.k%d", i, j), "foo")
+					assert.NoError(t, err)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+
+		mp := NewMsgpackBackend(store())
+
+		for i := 0; i < 2; i++ {
+			for j := 0; j < keys; j++ {
+				val, err := mp.Get("aabbcc", "default", fmt.Sprintf("w%d.k%d", i, j))
+				require.NoError(t, err)
+
+				assert.Equal(t, "foo", val, "w%d.k%d is missing", i, j)
+			}
+		}
+
+		// Only a batch keeps the history in step with the document.
+		if _, ok := store().(BatchStore); !ok {
+			return
+		}
+
+		revs, err := mp.History("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, 2*keys, len(revs))
+	})
+
+	n.It("backs a MsgpackBackend", func() {
+		mp := NewMsgpackBackend(store())
+
+		err := mp.Set("aabbcc", "default", "blah.bar", "foo")
+		require.NoError(t, err)
+
+		val, err := mp.Get("aabbcc", "default", "blah.bar")
+		require.NoError(t, err)
+
+		assert.Equal(t, "foo", val)
+	})
+}
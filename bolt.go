@@ -0,0 +1,173 @@
+package datum
+
+import (
+	"bytes"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// BoltStore keeps every blob in a single bbolt database file, with a
+// bucket per token holding a key per space.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db}, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStore) Set(token, space string, val []byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(space), val)
+	})
+}
+
+func (b *BoltStore) Get(token, space string) ([]byte, error) {
+	var data []byte
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(token))
+		if bucket == nil {
+			return nil
+		}
+
+		// Values are only valid during the transaction, so copy it out.
+		if val := bucket.Get([]byte(space)); val != nil {
+			data = append([]byte{}, val...)
+		}
+
+		return nil
+	})
+
+	return data, err
+}
+
+func (b *BoltStore) List(token string) ([]string, error) {
+	var spaces []string
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(token))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			spaces = append(spaces, string(k))
+			return nil
+		})
+	})
+
+	return spaces, err
+}
+
+func (b *BoltStore) Delete(token, space string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(token))
+		if bucket == nil {
+			return nil
+		}
+
+		err := bucket.Delete([]byte(space))
+		if err != nil {
+			return err
+		}
+
+		if k, _ := bucket.Cursor().First(); k == nil {
+			return tx.DeleteBucket([]byte(token))
+		}
+
+		return nil
+	})
+}
+
+func (b *BoltStore) CompareAndSet(token, space string, old, val []byte) (bool, error) {
+	var swapped bool
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return err
+		}
+
+		cur := bucket.Get([]byte(space))
+
+		if (cur == nil) != (old == nil) || !bytes.Equal(cur, old) {
+			return nil
+		}
+
+		swapped = true
+
+		return bucket.Put([]byte(space), val)
+	})
+
+	return swapped, err
+}
+
+// SetBatch sets every blob in one transaction, so either all of them are
+// written or none are.
+func (b *BoltStore) SetBatch(token string, blobs map[string][]byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return err
+		}
+
+		for space, val := range blobs {
+			err = bucket.Put([]byte(space), val)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// CompareAndSetBatch sets every blob in one transaction, if those in old
+// are unchanged.
+func (b *BoltStore) CompareAndSetBatch(token string, old map[string][]byte, blobs map[string][]byte) (bool, error) {
+	var swapped bool
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return err
+		}
+
+		for space, blob := range old {
+			cur := bucket.Get([]byte(space))
+
+			if (cur == nil) != (blob == nil) || !bytes.Equal(cur, blob) {
+				return nil
+			}
+		}
+
+		for space, val := range blobs {
+			err = bucket.Put([]byte(space), val)
+			if err != nil {
+				return err
+			}
+		}
+
+		swapped = true
+
+		return nil
+	})
+
+	return swapped, err
+}
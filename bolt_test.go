@@ -0,0 +1,61 @@
+package datum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestBoltStore(t *testing.T) {
+	n := neko.Start(t)
+
+	var bolt *BoltStore
+
+	tmpdir, err := ioutil.TempDir("", "bolt")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(tmpdir)
+
+	path := filepath.Join(tmpdir, "config.db")
+
+	n.Setup(func() {
+		var err error
+
+		bolt, err = NewBoltStore(path)
+		require.NoError(t, err)
+	})
+
+	n.Cleanup(func() {
+		bolt.Close()
+		os.Remove(path)
+	})
+
+	testBlobStore(t, n, func() BlobStore {
+		return bolt
+	})
+
+	n.It("sets several spaces in one batch", func() {
+		err := bolt.SetBatch("aabbcc", map[string][]byte{
+			"default": []byte("foo"),
+			"other":   []byte("bar"),
+		})
+		require.NoError(t, err)
+
+		data, err := bolt.Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+
+		data, err = bolt.Get("aabbcc", "other")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("bar"), data)
+	})
+
+	n.Meow()
+}
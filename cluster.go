@@ -0,0 +1,896 @@
+package datum
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmizerany/pat"
+	"github.com/hashicorp/raft"
+	"github.com/ugorji/go/codec"
+)
+
+var (
+	ErrNoLeader    = errors.New("no cluster leader")
+	ErrSyncTimeout = errors.New("timed out catching up with the leader")
+)
+
+// The longest a write may take to commit, or a read to catch up.
+const clusterTimeout = 10 * time.Second
+
+// Consistency is how up to date a read must be.
+type Consistency int
+
+const (
+	// Stale reads return what the node has, which may be missing writes
+	// recently made through other nodes.
+	Stale Consistency = iota
+
+	// Leader reads see every write committed before they began.
+	Leader
+)
+
+func ParseConsistency(str string) (Consistency, error) {
+	switch str {
+	case "", "stale":
+		return Stale, nil
+	case "leader":
+		return Leader, nil
+	}
+
+	return Stale, fmt.Errorf("unknown consistency: %s", str)
+}
+
+// Syncer is implemented by Backends whose reads may lag behind their
+// writes. Sync blocks until reads have the given consistency.
+type Syncer interface {
+	Sync(c Consistency) error
+}
+
+// sync brings the backend up to the consistency asked for by req, stale
+// by default. If it can't, an error is written to w and false returned.
+func (h *HTTPApi) sync(w http.ResponseWriter, req *http.Request) bool {
+	c, err := ParseConsistency(req.URL.Query().Get("consistency"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+
+	if s, ok := h.be.(Syncer); ok {
+		err = s.Sync(c)
+		if err != nil {
+			writeError(w, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+type ClusterConfig struct {
+	// ID names this node in the cluster. It must be a valid name.
+	ID string
+
+	// Addr is the URL other nodes reach this node's HTTP API at.
+	Addr string
+
+	// Secret is shared by the nodes to authenticate their requests to
+	// each other. The cluster API refuses any request without it.
+	Secret string
+
+	// Raft is the Raft configuration, or nil for the default one.
+	Raft *raft.Config
+
+	// MaxRevisions is how many revisions of each space are kept, or
+	// DefaultMaxRevisions if 0. A negative number keeps all of them. Every
+	// node should keep the same number.
+	MaxRevisions int
+
+	Transport raft.Transport
+	Logs      raft.LogStore
+	Stable    raft.StableStore
+	Snapshots raft.SnapshotStore
+}
+
+// Cluster is a Backend replicated across several nodes with Raft. Its
+// state is kept in memory and made durable by the Raft log and snapshots.
+// Writes made on a follower are forwarded to the leader.
+//
+// Cluster also serves the cluster API, under /_cluster/, which nodes use
+// to join and to forward to each other.
+type Cluster struct {
+	id     string
+	addr   string
+	secret string
+
+	store *MemoryStore
+	local *MsgpackBackend
+
+	raft  *raft.Raft
+	trans raft.Transport
+
+	client *http.Client
+	mux    *pat.PatternServeMux
+
+	done chan struct{}
+}
+
+// command is a write, as applied through the Raft log.
+type command struct {
+	Op     string        `codec:"op"`
+	Writer string        `codec:"writer"`
+	Token  string        `codec:"token"`
+	Space  string        `codec:"space"`
+	Key    string        `codec:"key"`
+	Value  interface{}   `codec:"value"`
+	Cond   *Precondition `codec:"cond"`
+	Index  uint64        `codec:"index"`
+	Merge  bool          `codec:"merge"`
+	Patch  []PatchOp     `codec:"patch"`
+
+	// Time is when the write was made, in nanoseconds since the epoch.
+	// It's set once, before the command goes into the log, so every node
+	// records the same one.
+	Time int64 `codec:"time"`
+}
+
+// applyResult is what applying a command returns.
+type applyResult struct {
+	Index uint64
+	Err   error
+}
+
+// applyReply is an applyResult sent back to the node that forwarded it.
+type applyReply struct {
+	Index uint64 `codec:"index"`
+	Err   string `codec:"err"`
+}
+
+// Member is a node of a cluster.
+type Member struct {
+	ID     string `json:"id"`
+	Raft   string `json:"raft"`
+	Addr   string `json:"addr"`
+	Leader bool   `json:"leader"`
+}
+
+// The "_" token's space mapping node IDs to their Addr.
+const nodesSpace = "nodes"
+
+func NewCluster(conf *ClusterConfig) (*Cluster, error) {
+	if !ValidName(conf.ID) {
+		return nil, ErrInvalidName
+	}
+
+	store := NewMemoryStore()
+
+	local := NewMsgpackBackend(store)
+
+	switch {
+	case conf.MaxRevisions > 0:
+		local.MaxRevisions = conf.MaxRevisions
+	case conf.MaxRevisions < 0:
+		local.MaxRevisions = 0
+	}
+
+	c := &Cluster{
+		id:     conf.ID,
+		addr:   conf.Addr,
+		secret: conf.Secret,
+		store:  store,
+		local:  local,
+		trans:  conf.Transport,
+		client: &http.Client{Timeout: clusterTimeout},
+		mux:    pat.New(),
+		done:   make(chan struct{}),
+	}
+
+	rc := raft.DefaultConfig()
+	if conf.Raft != nil {
+		*rc = *conf.Raft
+	}
+
+	notify := make(chan bool, 1)
+
+	rc.LocalID = raft.ServerID(conf.ID)
+	rc.NotifyCh = notify
+
+	r, err := raft.NewRaft(rc, &clusterFSM{c}, conf.Logs, conf.Stable, conf.Snapshots, conf.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	c.raft = r
+
+	c.mux.Post("/_cluster/apply", http.HandlerFunc(c.serveApply))
+	c.mux.Get("/_cluster/index", http.HandlerFunc(c.serveIndex))
+	c.mux.Post("/_cluster/join", http.HandlerFunc(c.serveJoin))
+	c.mux.Post("/_cluster/remove", http.HandlerFunc(c.serveRemove))
+	c.mux.Get("/_cluster/members", http.HandlerFunc(c.serveMembers))
+
+	go c.watchLeadership(notify)
+
+	return c, nil
+}
+
+// Bootstrap starts a new cluster with this node as its only member.
+func (c *Cluster) Bootstrap() error {
+	conf := raft.Configuration{
+		Servers: []raft.Server{
+			{ID: raft.ServerID(c.id), Address: c.trans.LocalAddr()},
+		},
+	}
+
+	return c.raft.BootstrapCluster(conf).Error()
+}
+
+// Join asks the cluster that the node at addr is part of to add this one.
+func (c *Cluster) Join(addr string) error {
+	form := url.Values{
+		"id":   {c.id},
+		"raft": {string(c.trans.LocalAddr())},
+		"addr": {c.addr},
+	}
+
+	resp, err := c.request("POST", addr+"/_cluster/join", form)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return clusterResponseError(addr, resp)
+	}
+
+	return nil
+}
+
+func (c *Cluster) Shutdown() error {
+	close(c.done)
+	return c.raft.Shutdown().Error()
+}
+
+// watchLeadership records this node's Addr whenever it becomes the
+// leader, so the others can forward to it. Nodes that join have theirs
+// recorded by the leader, but the one that bootstraps the cluster has no
+// one else to do it.
+func (c *Cluster) watchLeadership(notify chan bool) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case leader := <-notify:
+			if leader {
+				go c.applyLocal(&command{
+					Op:     "set",
+					Writer: "_",
+					Token:  "_",
+					Space:  nodesSpace,
+					Key:    c.id,
+					Value:  c.addr,
+				})
+			}
+		}
+	}
+}
+
+func (c *Cluster) Set(token, space, key string, val interface{}) error {
+	return c.SetBy(token, token, space, key, val)
+}
+
+func (c *Cluster) SetBy(writer, token, space, key string, val interface{}) error {
+	return c.SetIf(writer, token, space, key, val, nil)
+}
+
+func (c *Cluster) SetIf(writer, token, space, key string, val interface{}, cond *Precondition) error {
+	_, err := c.apply(&command{
+		Op:     "set",
+		Writer: writer,
+		Token:  token,
+		Space:  space,
+		Key:    key,
+		Value:  val,
+		Cond:   cond,
+	})
+
+	return err
+}
+
+func (c *Cluster) Update(writer, token, space string, doc map[string]interface{}, merge bool, cond *Precondition) error {
+	_, err := c.apply(&command{
+		Op:     "update",
+		Writer: writer,
+		Token:  token,
+		Space:  space,
+		Value:  doc,
+		Cond:   cond,
+		Merge:  merge,
+	})
+
+	return err
+}
+
+func (c *Cluster) Patch(writer, token, space string, ops []PatchOp, cond *Precondition) error {
+	_, err := c.apply(&command{
+		Op:     "patch",
+		Writer: writer,
+		Token:  token,
+		Space:  space,
+		Patch:  ops,
+		Cond:   cond,
+	})
+
+	return err
+}
+
+func (c *Cluster) Rollback(writer, token, space string, idx uint64) (uint64, error) {
+	return c.apply(&command{
+		Op:     "rollback",
+		Writer: writer,
+		Token:  token,
+		Space:  space,
+		Index:  idx,
+	})
+}
+
+func (c *Cluster) DeleteSpace(token, space string, cond *Precondition) error {
+	_, err := c.apply(&command{
+		Op:    "deletespace",
+		Token: token,
+		Space: space,
+		Cond:  cond,
+	})
+
+	return err
+}
+
+func (c *Cluster) DeleteToken(token string) error {
+	_, err := c.apply(&command{
+		Op:    "deletetoken",
+		Token: token,
+	})
+
+	return err
+}
+
+func (c *Cluster) Get(token, space, key string) (interface{}, error) {
+	return c.local.Get(token, space, key)
+}
+
+func (c *Cluster) List(token string) ([]string, error) {
+	return c.local.List(token)
+}
+
+func (c *Cluster) Index(token, space string) (uint64, error) {
+	return c.local.Index(token, space)
+}
+
+func (c *Cluster) History(token, space string) ([]*Revision, error) {
+	return c.local.History(token, space)
+}
+
+func (c *Cluster) GetRevision(token, space string, idx uint64, key string) (interface{}, error) {
+	return c.local.GetRevision(token, space, idx, key)
+}
+
+func (c *Cluster) RevisionAt(token, space string, t time.Time) (uint64, error) {
+	return c.local.RevisionAt(token, space, t)
+}
+
+// Subscribe registers fn to be called with every change as this node
+// applies it, whichever node it was made through.
+func (c *Cluster) Subscribe(fn func(*Change)) {
+	c.local.Subscribe(fn)
+}
+
+func (c *Cluster) Sync(cons Consistency) error {
+	if cons == Stale {
+		return nil
+	}
+
+	if c.raft.State() == raft.Leader {
+		_, err := c.readIndex()
+		return err
+	}
+
+	addr, err := c.leaderAddr()
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.request("GET", addr+"/_cluster/index", nil)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return clusterResponseError(addr, resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	idx, err := strconv.ParseUint(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(clusterTimeout)
+
+	for c.raft.AppliedIndex() < idx {
+		if time.Now().After(deadline) {
+			return ErrSyncTimeout
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// readIndex confirms this node is still the leader and returns the index
+// by which every write committed so far has been applied.
+func (c *Cluster) readIndex() (uint64, error) {
+	err := c.raft.VerifyLeader().Error()
+	if err == raft.ErrNotLeader {
+		return 0, ErrNoLeader
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.raft.Barrier(clusterTimeout).Error()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.raft.AppliedIndex(), nil
+}
+
+// apply commits cmd, forwarding it to the leader if this node isn't it.
+func (c *Cluster) apply(cmd *command) (uint64, error) {
+	if c.raft.State() != raft.Leader {
+		return c.forward(cmd)
+	}
+
+	idx, err := c.applyLocal(cmd)
+	if err == raft.ErrNotLeader {
+		return c.forward(cmd)
+	}
+
+	return idx, err
+}
+
+func (c *Cluster) applyLocal(cmd *command) (uint64, error) {
+	if cmd.Time == 0 {
+		cmd.Time = time.Now().UnixNano()
+	}
+
+	var data []byte
+
+	err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	f := c.raft.Apply(data, clusterTimeout)
+
+	err = f.Error()
+	if err != nil {
+		return 0, err
+	}
+
+	res := f.Response().(*applyResult)
+
+	return res.Index, res.Err
+}
+
+func (c *Cluster) forward(cmd *command) (uint64, error) {
+	addr, err := c.leaderAddr()
+	if err != nil {
+		return 0, err
+	}
+
+	var data []byte
+
+	err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.request("POST", addr+"/_cluster/apply", data)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, clusterResponseError(addr, resp)
+	}
+
+	var reply applyReply
+
+	err = codec.NewDecoder(resp.Body, msgpackHandle).Decode(&reply)
+	if err != nil {
+		return 0, err
+	}
+
+	return reply.Index, clusterError(reply.Err)
+}
+
+// The errors that keep their identity when returned by another node.
+var clusterErrors = []error{ErrPreconditionFailed, ErrNoRevision, ErrNoLeader}
+
+func clusterError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+
+	for _, err := range clusterErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(msg, patchErrorPrefix) {
+		return &PatchError{msg[len(patchErrorPrefix):]}
+	}
+
+	return errors.New(msg)
+}
+
+func clusterResponseError(addr string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	msg := strings.TrimSpace(string(body))
+
+	if err := clusterError(msg); err == ErrNoLeader {
+		return err
+	}
+
+	return fmt.Errorf("%s: %s: %s", addr, resp.Status, msg)
+}
+
+// leaderAddr returns the Addr of the leader.
+func (c *Cluster) leaderAddr() (string, error) {
+	leader := c.raft.Leader()
+	if leader == "" {
+		return "", ErrNoLeader
+	}
+
+	f := c.raft.GetConfiguration()
+
+	err := f.Error()
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range f.Configuration().Servers {
+		if s.Address != leader {
+			continue
+		}
+
+		val, err := c.local.Get("_", nodesSpace, string(s.ID))
+		if err != nil {
+			return "", err
+		}
+
+		if addr, ok := val.(string); ok {
+			return addr, nil
+		}
+	}
+
+	return "", ErrNoLeader
+}
+
+// request makes a request of another node. body is either the form to
+// post or the raw body.
+func (c *Cluster) request(method, target string, body interface{}) (*http.Response, error) {
+	var (
+		r           io.Reader
+		contentType string
+	)
+
+	switch b := body.(type) {
+	case url.Values:
+		r = strings.NewReader(b.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case []byte:
+		r = bytes.NewReader(b)
+		contentType = "application/msgpack"
+	}
+
+	req, err := http.NewRequest(method, target, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	req.Header.Set("Cluster-Secret", c.secret)
+
+	return c.client.Do(req)
+}
+
+func (c *Cluster) Members() ([]*Member, error) {
+	f := c.raft.GetConfiguration()
+
+	err := f.Error()
+	if err != nil {
+		return nil, err
+	}
+
+	leader := c.raft.Leader()
+
+	var members []*Member
+
+	for _, s := range f.Configuration().Servers {
+		addr, err := c.local.Get("_", nodesSpace, string(s.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		str, _ := addr.(string)
+
+		members = append(members, &Member{
+			ID:     string(s.ID),
+			Raft:   string(s.Address),
+			Addr:   str,
+			Leader: s.Address == leader,
+		})
+	}
+
+	return members, nil
+}
+
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Forwarded writes skip the checks HTTPApi makes, so only the other
+	// nodes may use the cluster API.
+	if c.secret == "" || !hmac.Equal([]byte(req.Header.Get("Cluster-Secret")), []byte(c.secret)) {
+		http.Error(w, "invalid cluster secret", 403)
+		return
+	}
+
+	c.mux.ServeHTTP(w, req)
+}
+
+func (c *Cluster) serveApply(w http.ResponseWriter, req *http.Request) {
+	if c.raft.State() != raft.Leader {
+		http.Error(w, ErrNoLeader.Error(), 503)
+		return
+	}
+
+	var cmd command
+
+	err := codec.NewDecoder(req.Body, msgpackHandle).Decode(&cmd)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var reply applyReply
+
+	reply.Index, err = c.applyLocal(&cmd)
+	if err != nil {
+		reply.Err = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/msgpack")
+
+	codec.NewEncoder(w, msgpackHandle).Encode(&reply)
+}
+
+func (c *Cluster) serveIndex(w http.ResponseWriter, req *http.Request) {
+	idx, err := c.readIndex()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%d\n", idx)
+}
+
+// leading reports if this node is the leader. If it isn't, req is passed
+// on to the leader and its response written to w.
+func (c *Cluster) leading(w http.ResponseWriter, req *http.Request) bool {
+	if c.raft.State() == raft.Leader {
+		return true
+	}
+
+	addr, err := c.leaderAddr()
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+
+	resp, err := c.request("POST", addr+req.URL.Path, req.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return false
+	}
+
+	defer resp.Body.Close()
+
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+
+	return false
+}
+
+func (c *Cluster) serveJoin(w http.ResponseWriter, req *http.Request) {
+	if !c.leading(w, req) {
+		return
+	}
+
+	var (
+		id       = req.FormValue("id")
+		raftAddr = req.FormValue("raft")
+		addr     = req.FormValue("addr")
+	)
+
+	if !ValidName(id) || raftAddr == "" || addr == "" {
+		http.Error(w, "id, raft and addr are required", 400)
+		return
+	}
+
+	_, err := c.applyLocal(&command{
+		Op:     "set",
+		Writer: "_",
+		Token:  "_",
+		Space:  nodesSpace,
+		Key:    id,
+		Value:  addr,
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = c.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(raftAddr), 0, clusterTimeout).Error()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (c *Cluster) serveRemove(w http.ResponseWriter, req *http.Request) {
+	if !c.leading(w, req) {
+		return
+	}
+
+	id := req.FormValue("id")
+
+	if !ValidName(id) {
+		http.Error(w, "id is required", 400)
+		return
+	}
+
+	err := c.raft.RemoveServer(raft.ServerID(id), 0, clusterTimeout).Error()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	_, err = c.applyLocal(&command{
+		Op:     "set",
+		Writer: "_",
+		Token:  "_",
+		Space:  nodesSpace,
+		Key:    id,
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (c *Cluster) serveMembers(w http.ResponseWriter, req *http.Request) {
+	members, err := c.Members()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// clusterFSM applies the Raft log to a Cluster's local backend.
+type clusterFSM struct {
+	c *Cluster
+}
+
+func (f *clusterFSM) Apply(l *raft.Log) interface{} {
+	var cmd command
+
+	err := codec.NewDecoderBytes(l.Data, msgpackHandle).Decode(&cmd)
+	if err != nil {
+		return &applyResult{Err: err}
+	}
+
+	var res applyResult
+
+	at := time.Unix(0, cmd.Time)
+
+	switch cmd.Op {
+	case "set":
+		res.Err = f.c.local.set(at, cmd.Writer, cmd.Token, cmd.Space, cmd.Key, cmd.Value, cmd.Cond)
+	case "update":
+		doc, _ := cmd.Value.(map[string]interface{})
+		res.Err = f.c.local.update(at, cmd.Writer, cmd.Token, cmd.Space, doc, cmd.Merge, cmd.Cond)
+	case "patch":
+		res.Err = f.c.local.patch(at, cmd.Writer, cmd.Token, cmd.Space, cmd.Patch, cmd.Cond)
+	case "rollback":
+		res.Index, res.Err = f.c.local.rollback(at, cmd.Writer, cmd.Token, cmd.Space, cmd.Index)
+	case "deletespace":
+		res.Err = f.c.local.DeleteSpace(cmd.Token, cmd.Space, cmd.Cond)
+	case "deletetoken":
+		res.Err = f.c.local.DeleteToken(cmd.Token)
+	default:
+		res.Err = fmt.Errorf("unknown command: %s", cmd.Op)
+	}
+
+	return &res
+}
+
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	data, err := f.c.store.dump()
+	if err != nil {
+		return nil, err
+	}
+
+	return &clusterSnapshot{data}, nil
+}
+
+func (f *clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	return f.c.store.load(data)
+}
+
+type clusterSnapshot struct {
+	data []byte
+}
+
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := sink.Write(s.data)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *clusterSnapshot) Release() {}
@@ -0,0 +1,388 @@
+package datum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+type testNode struct {
+	*Cluster
+
+	srv *httptest.Server
+	api *HTTPApi
+}
+
+// startCluster starts a cluster of size in-process nodes, the first of
+// which is the leader.
+func startCluster(t *testing.T, size int) []*testNode {
+	var (
+		nodes      []*testNode
+		transports []*raft.InmemTransport
+	)
+
+	for i := 0; i < size; i++ {
+		_, trans := raft.NewInmemTransport("")
+
+		for _, other := range transports {
+			trans.Connect(other.LocalAddr(), other)
+			other.Connect(trans.LocalAddr(), trans)
+		}
+
+		transports = append(transports, trans)
+
+		conf := raft.DefaultConfig()
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogOutput = ioutil.Discard
+
+		node := &testNode{}
+
+		node.srv = httptest.NewUnstartedServer(nil)
+
+		store := raft.NewInmemStore()
+
+		c, err := NewCluster(&ClusterConfig{
+			ID:        fmt.Sprintf("node%d", i),
+			Addr:      "http://" + node.srv.Listener.Addr().String(),
+			Secret:    "secret",
+			Raft:      conf,
+			Transport: trans,
+			Logs:      store,
+			Stable:    store,
+			Snapshots: raft.NewInmemSnapshotStore(),
+		})
+		require.NoError(t, err)
+
+		node.Cluster = c
+		node.api = NewHTTPApi(UUIDTokenGen(), c)
+
+		mux := http.NewServeMux()
+		mux.Handle("/_cluster/", c)
+		mux.Handle("/", node.api)
+
+		node.srv.Config.Handler = mux
+		node.srv.Start()
+
+		if i == 0 {
+			require.NoError(t, c.Bootstrap())
+			waitFor(t, func() bool {
+				_, err := c.leaderAddr()
+				return err == nil
+			})
+		} else {
+			require.NoError(t, c.Join(nodes[0].addr))
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func stopCluster(nodes []*testNode) {
+	for _, node := range nodes {
+		node.Shutdown()
+		node.srv.Close()
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	n := neko.Start(t)
+
+	var nodes []*testNode
+
+	n.Setup(func() {
+		nodes = startCluster(t, 3)
+	})
+
+	n.Cleanup(func() {
+		stopCluster(nodes)
+	})
+
+	n.It("forwards writes on followers to the leader", func() {
+		err := nodes[1].SetBy("aabbcc", "aabbcc", "default", "blah", "foo")
+		require.NoError(t, err)
+
+		for _, node := range nodes {
+			require.NoError(t, node.Sync(Leader))
+
+			val, err := node.Get("aabbcc", "default", "blah")
+			require.NoError(t, err)
+
+			assert.Equal(t, "foo", val)
+		}
+	})
+
+	n.It("returns the errors of forwarded writes", func() {
+		cond := &Precondition{IfMatch: `"nope"`}
+
+		err := nodes[2].SetIf("aabbcc", "aabbcc", "default", "blah", "foo", cond)
+		assert.Equal(t, ErrPreconditionFailed, err)
+
+		_, err = nodes[2].Rollback("aabbcc", "aabbcc", "default", 5)
+		assert.Equal(t, ErrNoRevision, err)
+	})
+
+	n.It("replicates revisions", func() {
+		require.NoError(t, nodes[0].Set("aabbcc", "default", "blah", "foo"))
+		require.NoError(t, nodes[1].Set("aabbcc", "default", "blah", "bar"))
+
+		idx, err := nodes[2].Rollback("aabbcc", "aabbcc", "default", 1)
+		require.NoError(t, err)
+
+		assert.Equal(t, uint64(3), idx)
+
+		require.NoError(t, nodes[1].Sync(Leader))
+
+		val, err := nodes[1].Get("aabbcc", "default", "blah")
+		require.NoError(t, err)
+
+		assert.Equal(t, "foo", val)
+	})
+
+	n.It("records the same revision times on every node", func() {
+		require.NoError(t, nodes[1].Set("aabbcc", "default", "blah", "foo"))
+
+		var times []time.Time
+
+		for _, node := range nodes {
+			require.NoError(t, node.Sync(Leader))
+
+			revs, err := node.History("aabbcc", "default")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(revs))
+
+			times = append(times, revs[0].Time)
+		}
+
+		assert.Equal(t, times[0], times[1])
+		assert.Equal(t, times[0], times[2])
+	})
+
+	n.It("replicates deletes", func() {
+		require.NoError(t, nodes[0].Set("aabbcc", "default", "blah", "foo"))
+		require.NoError(t, nodes[0].Set("aabbcc", "other", "blah", "foo"))
+
+		require.NoError(t, nodes[1].DeleteSpace("aabbcc", "default", nil))
+
+		require.NoError(t, nodes[2].Sync(Leader))
+
+		spaces, err := nodes[2].List("aabbcc")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"other"}, spaces)
+
+		require.NoError(t, nodes[2].DeleteToken("aabbcc"))
+
+		require.NoError(t, nodes[1].Sync(Leader))
+
+		spaces, err = nodes[1].List("aabbcc")
+		require.NoError(t, err)
+
+		assert.Empty(t, spaces)
+	})
+
+	n.It("replicates document updates", func() {
+		require.NoError(t, nodes[0].Set("aabbcc", "default", "name", "vektra"))
+
+		doc := map[string]interface{}{
+			"sub": map[string]interface{}{"blah": "foo"},
+		}
+
+		require.NoError(t, nodes[1].Update("aabbcc", "aabbcc", "default", doc, true, nil))
+
+		require.NoError(t, nodes[2].Sync(Leader))
+
+		val, err := nodes[2].Get("aabbcc", "default", "")
+		require.NoError(t, err)
+
+		expected := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "foo"},
+		}
+
+		assert.Equal(t, expected, val)
+	})
+
+	n.It("returns the errors of forwarded patches", func() {
+		ops := []PatchOp{{Op: "remove", Path: "/nope"}}
+
+		err := nodes[1].Patch("aabbcc", "aabbcc", "default", ops, nil)
+		assert.IsType(t, &PatchError{}, err)
+	})
+
+	n.It("serves consistent reads over http", func() {
+		req, err := http.NewRequest("PUT", nodes[1].srv.URL+"/aabbcc/~def/blah", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.Equal(t, 200, resp.StatusCode)
+
+		resp, err = http.Get(nodes[2].srv.URL + "/aabbcc/~def/blah?consistency=leader")
+		require.NoError(t, err)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "foo\n", string(body))
+	})
+
+	n.It("lists its members", func() {
+		req, err := http.NewRequest("GET", nodes[1].srv.URL+"/_cluster/members", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Cluster-Secret", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		var members []*Member
+
+		err = json.NewDecoder(resp.Body).Decode(&members)
+		require.NoError(t, err)
+
+		require.Equal(t, 3, len(members))
+
+		assert.Equal(t, "node0", members[0].ID)
+		assert.Equal(t, nodes[0].srv.URL, members[0].Addr)
+		assert.True(t, members[0].Leader)
+		assert.False(t, members[1].Leader)
+	})
+
+	n.It("removes members", func() {
+		req, err := http.NewRequest("POST", nodes[1].srv.URL+"/_cluster/remove", strings.NewReader("id=node2"))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cluster-Secret", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.Equal(t, 200, resp.StatusCode)
+
+		members, err := nodes[0].Members()
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, len(members))
+	})
+
+	n.It("refuses cluster requests without the secret", func() {
+		resp, err := http.Post(nodes[0].srv.URL+"/_cluster/apply", "application/msgpack", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, 403, resp.StatusCode)
+	})
+
+	n.It("restores its state from a snapshot", func() {
+		require.NoError(t, nodes[0].Set("aabbcc", "default", "blah", "foo"))
+
+		snap, err := (&clusterFSM{nodes[0].Cluster}).Snapshot()
+		require.NoError(t, err)
+
+		var sink testSink
+
+		require.NoError(t, snap.Persist(&sink))
+
+		c := &Cluster{store: NewMemoryStore()}
+		c.local = NewMsgpackBackend(c.store)
+
+		err = (&clusterFSM{c}).Restore(ioutil.NopCloser(&sink.Buffer))
+		require.NoError(t, err)
+
+		val, err := c.Get("aabbcc", "default", "blah")
+		require.NoError(t, err)
+
+		assert.Equal(t, "foo", val)
+	})
+
+	n.Meow()
+}
+
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
+
+func TestClusterConfig(t *testing.T) {
+	n := neko.Start(t)
+
+	newCluster := func(maxRevisions int) *Cluster {
+		_, trans := raft.NewInmemTransport("")
+
+		conf := raft.DefaultConfig()
+		conf.LogOutput = ioutil.Discard
+
+		store := raft.NewInmemStore()
+
+		c, err := NewCluster(&ClusterConfig{
+			ID:           "node0",
+			Addr:         "http://localhost",
+			Secret:       "secret",
+			Raft:         conf,
+			MaxRevisions: maxRevisions,
+			Transport:    trans,
+			Logs:         store,
+			Stable:       store,
+			Snapshots:    raft.NewInmemSnapshotStore(),
+		})
+		require.NoError(t, err)
+
+		return c
+	}
+
+	n.It("keeps as many revisions as it's told to", func() {
+		limits := map[int]int{
+			0:  DefaultMaxRevisions,
+			3:  3,
+			-1: 0,
+		}
+
+		for maxRevisions, expected := range limits {
+			c := newCluster(maxRevisions)
+
+			assert.Equal(t, expected, c.local.MaxRevisions, "MaxRevisions: %d", maxRevisions)
+
+			c.Shutdown()
+		}
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,545 @@
+package datum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vektra/go-toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Encoder writes values in some format.
+type Encoder interface {
+	// Encode writes val, the value at key, to w. params are the query
+	// params of the request, for encoders that take options.
+	Encode(w io.Writer, key string, val interface{}, params url.Values) error
+}
+
+// Decoder reads values in some format.
+type Decoder interface {
+	Decode(r io.Reader) (interface{}, error)
+}
+
+// EncoderFunc lets a func be used as an Encoder.
+type EncoderFunc func(w io.Writer, key string, val interface{}, params url.Values) error
+
+func (f EncoderFunc) Encode(w io.Writer, key string, val interface{}, params url.Values) error {
+	return f(w, key, val, params)
+}
+
+// DecoderFunc lets a func be used as a Decoder.
+type DecoderFunc func(r io.Reader) (interface{}, error)
+
+func (f DecoderFunc) Decode(r io.Reader) (interface{}, error) {
+	return f(r)
+}
+
+// Codec is a format values can be read or written in. Either Encoder or
+// Decoder may be nil if it only goes one way.
+type Codec struct {
+	Name string
+
+	// MediaTypes are matched against Content-Type and Accept headers. The
+	// first one labels the responses written with Encoder.
+	MediaTypes []string
+
+	// Extensions are matched against the extension of a key, or of a
+	// space when the whole space is requested, such as ".json".
+	Extensions []string
+
+	Encoder Encoder
+	Decoder Decoder
+}
+
+// contentType is the Content-Type of the responses written with c.
+func (c *Codec) contentType() string {
+	if len(c.MediaTypes) == 0 {
+		return "text/plain; charset=utf-8"
+	}
+
+	return c.MediaTypes[0]
+}
+
+// ParamError is returned by an Encoder given query params it can't use.
+type ParamError struct {
+	Msg string
+}
+
+func (e *ParamError) Error() string {
+	return e.Msg
+}
+
+// CodecRegistry holds the codecs HTTPApi reads and writes values with.
+type CodecRegistry struct {
+	lock   sync.RWMutex
+	codecs []*Codec
+}
+
+// NewCodecRegistry returns a registry of the built in codecs. The first,
+// text, is used when a request doesn't ask for anything else.
+func NewCodecRegistry() *CodecRegistry {
+	r := &CodecRegistry{}
+
+	r.Register(textCodec)
+	r.Register(jsonCodec)
+	r.Register(tomlCodec)
+	r.Register(yamlCodec)
+	r.Register(envCodec)
+	r.Register(propertiesCodec)
+	r.Register(iniCodec)
+
+	return r
+}
+
+// Register adds c to the registry, replacing the codec of the same name
+// if there is one. Codecs registered earlier win when several match.
+func (r *CodecRegistry) Register(c *Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, cur := range r.codecs {
+		if cur.Name == c.Name {
+			r.codecs[i] = c
+			return
+		}
+	}
+
+	r.codecs = append(r.codecs, c)
+}
+
+// Default returns the codec used when a request doesn't ask for any.
+func (r *CodecRegistry) Default() *Codec {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.codecs[0]
+}
+
+// ForExtension returns the codec for ext, or nil if there is none.
+func (r *CodecRegistry) ForExtension(ext string) *Codec {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, c := range r.codecs {
+		for _, e := range c.Extensions {
+			if strings.EqualFold(e, ext) {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+// ForMediaType returns the codec for the media type in contentType, which
+// may carry params, or nil if there is none.
+func (r *CodecRegistry) ForMediaType(contentType string) *Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, c := range r.codecs {
+		for _, t := range c.MediaTypes {
+			if t == mediaType {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+// Negotiate returns the codec with an Encoder best matching an Accept
+// header, going by the quality of the most specific range matching each of
+// its media types. Ties go to the codec registered first, so an empty
+// header or */* picks the default. It returns nil if nothing is
+// acceptable.
+func (r *CodecRegistry) Negotiate(accept string) *Codec {
+	if strings.TrimSpace(accept) == "" {
+		return r.Default()
+	}
+
+	ranges := parseAccept(accept)
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var (
+		best  *Codec
+		bestQ float64
+	)
+
+	for _, c := range r.codecs {
+		if c.Encoder == nil {
+			continue
+		}
+
+		for _, t := range c.MediaTypes {
+			if q := acceptQuality(ranges, t); q > bestQ {
+				best, bestQ = c, q
+			}
+		}
+	}
+
+	return best
+}
+
+// acceptRange is one media range of an Accept header.
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+
+	return ranges
+}
+
+// acceptQuality returns the quality ranges give mediaType, taken from the
+// most specific range that matches it, or 0 if none does.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	var (
+		q           float64
+		specificity int
+	)
+
+	major := mediaType[:strings.IndexByte(mediaType+"/", '/')]
+
+	for _, r := range ranges {
+		var s int
+
+		switch r.mediaType {
+		case mediaType:
+			s = 3
+		case major + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+
+	return q
+}
+
+// keyExt splits the extension off key if there's a codec for it. Any other
+// dot is part of the key, as in host.name.
+func (h *HTTPApi) keyExt(key string) (string, string) {
+	ext := filepath.Ext(key)
+	if ext == "" || h.codecs.ForExtension(ext) == nil {
+		return key, ""
+	}
+
+	return key[:len(key)-len(ext)], ext
+}
+
+// responseCodec picks the codec to write a response in, from ext if there
+// is one or else the Accept header. If the Accept header matches none,
+// fallback is used. If none will do it writes a 406 and returns nil.
+func (h *HTTPApi) responseCodec(w http.ResponseWriter, req *http.Request, ext string, fallback *Codec) *Codec {
+	var c *Codec
+
+	if ext != "" {
+		c = h.codecs.ForExtension(ext)
+	} else if c = h.codecs.Negotiate(req.Header.Get("Accept")); c == nil {
+		c = fallback
+	}
+
+	if c == nil || c.Encoder == nil {
+		http.Error(w, "no acceptable format", 406)
+		return nil
+	}
+
+	return c
+}
+
+// requestCodec picks the codec to read a request body with, from ext if
+// there is one or else the Content-Type. Without either, or with a
+// Content-Type no codec has, fallback is used. If none will do it writes a
+// 415 and returns nil.
+func (h *HTTPApi) requestCodec(w http.ResponseWriter, req *http.Request, ext string, fallback *Codec) *Codec {
+	var c *Codec
+
+	if ext != "" {
+		c = h.codecs.ForExtension(ext)
+	} else if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		c = h.codecs.ForMediaType(contentType)
+	}
+
+	if c == nil && ext == "" {
+		c = fallback
+	}
+
+	if c == nil || c.Decoder == nil {
+		http.Error(w, "unsupported format", 415)
+		return nil
+	}
+
+	return c
+}
+
+// writeEncoded writes val, the value at key, to w with c.
+func writeEncoded(w http.ResponseWriter, c *Codec, key string, val interface{}, params url.Values) {
+	var buf bytes.Buffer
+
+	err := c.Encoder.Encode(&buf, key, val, params)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", c.contentType())
+	w.Write(buf.Bytes())
+}
+
+// RegisterCodec makes c available to requests, replacing the codec of the
+// same name if there is one.
+func (h *HTTPApi) RegisterCodec(c *Codec) {
+	h.codecs.Register(c)
+}
+
+// writeText writes values that aren't maps as plain strings, for the
+// formats that only describe maps.
+func writeText(w io.Writer, val interface{}) error {
+	if encVal, ok := val.(EncryptedValue); ok {
+		_, err := w.Write(encVal.Value)
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s\n", val)
+	return err
+}
+
+// mapEncoder returns an Encoder that writes maps with fn and anything
+// else as plain strings.
+func mapEncoder(fn func(w io.Writer, doc map[string]interface{}) error) Encoder {
+	return EncoderFunc(func(w io.Writer, key string, val interface{}, params url.Values) error {
+		if doc, ok := val.(map[string]interface{}); ok {
+			return fn(w, doc)
+		}
+
+		return writeText(w, val)
+	})
+}
+
+// mapDecoder returns a Decoder that reads maps with fn.
+func mapDecoder(fn func(r io.Reader) (map[string]interface{}, error)) Decoder {
+	return DecoderFunc(func(r io.Reader) (interface{}, error) {
+		return fn(r)
+	})
+}
+
+// textCodec writes maps as JSON and other values as plain strings, and
+// reads bodies as strings.
+var textCodec = &Codec{
+	Name:       "text",
+	MediaTypes: []string{"text/plain"},
+	Encoder:    mapEncoder(encodeJSON),
+	Decoder: DecoderFunc(func(r io.Reader) (interface{}, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(data), nil
+	}),
+}
+
+func encodeJSON(w io.Writer, doc map[string]interface{}) error {
+	return json.NewEncoder(w).Encode(doc)
+}
+
+var jsonCodec = &Codec{
+	Name:       "json",
+	MediaTypes: []string{"application/json"},
+	Extensions: []string{".json"},
+	Encoder: EncoderFunc(func(w io.Writer, key string, val interface{}, params url.Values) error {
+		return json.NewEncoder(w).Encode(val)
+	}),
+	Decoder: DecoderFunc(func(r io.Reader) (interface{}, error) {
+		var val interface{}
+
+		err := json.NewDecoder(r).Decode(&val)
+		if err != nil {
+			return nil, err
+		}
+
+		return val, nil
+	}),
+}
+
+var tomlCodec = &Codec{
+	Name:       "toml",
+	MediaTypes: []string{"application/toml", "text/x-toml"},
+	Extensions: []string{".toml"},
+	Encoder: mapEncoder(func(w io.Writer, doc map[string]interface{}) error {
+		_, err := fmt.Fprintf(w, "%s", toml.TreeFromMap(doc).ToString())
+		return err
+	}),
+	Decoder: mapDecoder(func(r io.Reader) (map[string]interface{}, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		tree, err := toml.Load(string(data))
+		if err != nil {
+			return nil, err
+		}
+
+		return tomlToMap(tree), nil
+	}),
+}
+
+// YAML has no registered media type, so it goes by all of the common
+// ones.
+var yamlCodec = &Codec{
+	Name:       "yaml",
+	MediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+	Extensions: []string{".yaml", ".yml"},
+	Encoder: EncoderFunc(func(w io.Writer, key string, val interface{}, params url.Values) error {
+		data, err := yaml.Marshal(val)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	}),
+	Decoder: DecoderFunc(func(r io.Reader) (interface{}, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var val interface{}
+
+		err = yaml.Unmarshal(data, &val)
+		if err != nil {
+			return nil, err
+		}
+
+		return yamlToJSON(val), nil
+	}),
+}
+
+var envCodec = &Codec{
+	Name:       "env",
+	Extensions: []string{".env"},
+	Encoder: EncoderFunc(func(w io.Writer, key string, val interface{}, params url.Values) error {
+		opts, err := parseEnvOptions(params)
+		if err != nil {
+			return err
+		}
+
+		return renderEnv(w, key, val, opts)
+	}),
+}
+
+var propertiesCodec = &Codec{
+	Name:       "properties",
+	MediaTypes: []string{"text/x-java-properties"},
+	Extensions: []string{".properties"},
+	Encoder: mapEncoder(func(w io.Writer, doc map[string]interface{}) error {
+		renderProperties(w, doc)
+		return nil
+	}),
+	Decoder: mapDecoder(parseProperties),
+}
+
+var iniCodec = &Codec{
+	Name:       "ini",
+	MediaTypes: []string{"text/x-ini"},
+	Extensions: []string{".ini"},
+	Encoder: mapEncoder(func(w io.Writer, doc map[string]interface{}) error {
+		renderINI(w, doc)
+		return nil
+	}),
+	Decoder: mapDecoder(parseINI),
+}
+
+func tomlToMap(tree *toml.TomlTree) map[string]interface{} {
+	doc := make(map[string]interface{})
+
+	for _, k := range tree.Keys() {
+		switch v := tree.Get(k).(type) {
+		case *toml.TomlTree:
+			doc[k] = tomlToMap(v)
+		case []*toml.TomlTree:
+			list := make([]interface{}, len(v))
+
+			for i, sub := range v {
+				list[i] = tomlToMap(sub)
+			}
+
+			doc[k] = list
+		default:
+			doc[k] = v
+		}
+	}
+
+	return doc
+}
+
+// yamlToJSON converts the map[interface{}]interface{} values yaml decodes
+// into the map[string]interface{} ones used everywhere else.
+func yamlToJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+
+		for k, sub := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(sub)
+		}
+
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+
+		for i, sub := range v {
+			list[i] = yamlToJSON(sub)
+		}
+
+		return list
+	default:
+		return v
+	}
+}
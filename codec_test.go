@@ -0,0 +1,56 @@
+package datum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektra/neko"
+)
+
+func TestCodecRegistry(t *testing.T) {
+	n := neko.Start(t)
+
+	var r *CodecRegistry
+
+	n.Setup(func() {
+		r = NewCodecRegistry()
+	})
+
+	n.It("defaults to text without an Accept header", func() {
+		assert.Equal(t, "text", r.Negotiate("").Name)
+		assert.Equal(t, "text", r.Negotiate("*/*").Name)
+	})
+
+	n.It("prefers the highest quality", func() {
+		assert.Equal(t, "yaml", r.Negotiate("application/json;q=0.8, application/yaml").Name)
+		assert.Equal(t, "json", r.Negotiate("text/*;q=0.2, application/json").Name)
+	})
+
+	n.It("takes the quality of the most specific range", func() {
+		c := r.Negotiate("text/*;q=0.3, text/plain;q=0.1, application/json;q=0.2")
+		assert.Equal(t, "toml", c.Name)
+	})
+
+	n.It("skips media types that aren't acceptable", func() {
+		assert.Nil(t, r.Negotiate("application/json;q=0"))
+		assert.Nil(t, r.Negotiate("image/png"))
+	})
+
+	n.It("finds codecs by extension and media type", func() {
+		assert.Equal(t, "yaml", r.ForExtension(".yml").Name)
+		assert.Equal(t, "json", r.ForMediaType("application/json; charset=utf-8").Name)
+		assert.Nil(t, r.ForExtension(".xml"))
+		assert.Nil(t, r.ForMediaType("application/xml"))
+	})
+
+	n.It("replaces codecs of the same name", func() {
+		json := &Codec{Name: "json", MediaTypes: []string{"application/json"}}
+
+		r.Register(json)
+
+		assert.Equal(t, json, r.ForMediaType("application/json"))
+		assert.Nil(t, r.ForExtension(".json"))
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+	"github.com/vektra/datum"
+)
+
+var fClusterID = flag.String("cluster-id", "", "ID of this node, to run as part of a cluster rather than use -store")
+var fClusterSecret = flag.String("cluster-secret", "", "Secret the nodes of the cluster share")
+var fAdvertise = flag.String("advertise", "", "URL the other nodes reach this one at, such as http://10.0.0.1:80")
+var fRaft = flag.String("raft", "", "Address to use for Raft traffic, such as 10.0.0.1:7000")
+var fRaftDir = flag.String("raft-dir", "raft", "Dir to keep the Raft log and snapshots in")
+var fBootstrap = flag.Bool("bootstrap", false, "Start a new cluster with this node as its first member")
+var fJoin = flag.String("join", "", "URL of a node in the cluster to join")
+
+func openCluster() (*datum.Cluster, error) {
+	if *fClusterSecret == "" || *fAdvertise == "" || *fRaft == "" {
+		return nil, fmt.Errorf("-cluster-secret, -advertise and -raft are required in a cluster")
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", *fRaft)
+	if err != nil {
+		return nil, err
+	}
+
+	trans, err := raft.NewTCPTransport(*fRaft, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(*fRaftDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(*fRaftDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(*fRaftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	// -revisions=0 keeps everything, which ClusterConfig spells -1.
+	revisions := *fRevisions
+	if revisions == 0 {
+		revisions = -1
+	}
+
+	c, err := datum.NewCluster(&datum.ClusterConfig{
+		ID:           *fClusterID,
+		Addr:         *fAdvertise,
+		Secret:       *fClusterSecret,
+		MaxRevisions: revisions,
+		Transport:    trans,
+		Logs:         logs,
+		Stable:       logs,
+		Snapshots:    snaps,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case *fBootstrap:
+		err = c.Bootstrap()
+	case *fJoin != "":
+		err = c.Join(*fJoin)
+	}
+
+	if err != nil {
+		c.Shutdown()
+		return nil, err
+	}
+
+	return c, nil
+}
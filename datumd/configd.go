@@ -2,25 +2,133 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/vektra/datum"
 )
 
 var fAddr = flag.String("addr", ":80", "Port to listen on")
+var fStore = flag.String("store", "disk", "Blob store to use: disk, bolt, sqlite, memory, redis or s3")
 var fDir = flag.String("dir", "config", "Config dir to use")
+var fHashed = flag.Bool("hashed", false, "Store config under hashed file names")
+var fDB = flag.String("db", "config.db", "Database file for the bolt and sqlite stores")
+var fRedis = flag.String("redis", "localhost:6379", "Address of the server for the redis store")
+var fRedisPrefix = flag.String("redis-prefix", "datum:", "Prefix of the keys in the redis store")
+var fS3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "Endpoint of the s3 store")
+var fS3Bucket = flag.String("s3-bucket", "", "Bucket of the s3 store")
+var fS3Region = flag.String("s3-region", "us-east-1", "Region of the s3 store")
+var fS3Prefix = flag.String("s3-prefix", "", "Prefix of the objects in the s3 store")
+var fSnapshot = flag.String("snapshot", "", "File to snapshot the memory store to on shutdown")
+var fRevisions = flag.Int("revisions", datum.DefaultMaxRevisions, "Revisions to keep of each space, or 0 for all")
+
+func openStore() (datum.BlobStore, error) {
+	switch *fStore {
+	case "disk":
+		bs := datum.NewDiskStore(*fDir)
+		bs.Hashed = *fHashed
+
+		removed, err := bs.RemoveTemp()
+		if err != nil {
+			return nil, fmt.Errorf("unable to clean config dir: %s", err)
+		}
+
+		for _, path := range removed {
+			log.Printf("removed incomplete write: %s", path)
+		}
+
+		return bs, nil
+	case "bolt":
+		return datum.NewBoltStore(*fDB)
+	case "sqlite":
+		return datum.OpenSQLiteStore(*fDB)
+	case "memory":
+		if *fSnapshot == "" {
+			return datum.NewMemoryStore(), nil
+		}
+
+		return datum.OpenMemoryStore(*fSnapshot)
+	case "redis":
+		rs := datum.NewRedisStore(*fRedis)
+		rs.Prefix = *fRedisPrefix
+
+		return rs, nil
+	case "s3":
+		if *fS3Bucket == "" {
+			return nil, fmt.Errorf("-s3-bucket is required")
+		}
+
+		s3 := datum.NewS3Store(*fS3Endpoint, *fS3Bucket, *fS3Region)
+		s3.Prefix = *fS3Prefix
+
+		// Credentials come from the environment, as with the AWS tools.
+		s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown store: %s", *fStore)
+	}
+}
 
 func main() {
 	flag.Parse()
 
 	tg := datum.UUIDTokenGen()
-	bs := datum.NewDiskStore(*fDir)
-	be := datum.NewMsgpackBackend(bs)
 
-	api := datum.NewHTTPApi(tg, be)
+	var handler http.Handler
+
+	if *fClusterID != "" {
+		c, err := openCluster()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go closeOnSignal(c.Shutdown)
 
-	err := http.ListenAndServe(*fAddr, api)
+		mux := http.NewServeMux()
+		mux.Handle("/_cluster/", c)
+		mux.Handle("/", datum.NewHTTPApi(tg, c))
+
+		handler = mux
+	} else {
+		bs, err := openStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if c, ok := bs.(io.Closer); ok {
+			go closeOnSignal(c.Close)
+		}
+
+		be := datum.NewMsgpackBackend(bs)
+		be.MaxRevisions = *fRevisions
+
+		handler = datum.NewHTTPApi(tg, be)
+	}
+
+	err := http.ListenAndServe(*fAddr, handler)
 	if err != nil {
 		panic(err)
 	}
 }
+
+// closeOnSignal calls close and exits once told to shut down.
+func closeOnSignal(close func() error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	<-sig
+
+	err := close()
+	if err != nil {
+		log.Fatalf("unable to shut down: %s", err)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+// The SQLite driver needs cgo, so without it -store=sqlite is unavailable
+// and the other stores still build.
+import _ "github.com/mattn/go-sqlite3"
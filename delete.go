@@ -0,0 +1,116 @@
+package datum
+
+import "net/http"
+
+// SpaceDeleter is implemented by Backends that can drop a whole space.
+// HTTPApi needs it for deleting spaces.
+type SpaceDeleter interface {
+	DeleteSpace(token string, space string, cond *Precondition) error
+}
+
+// TokenDeleter is implemented by Backends that can drop every space of a
+// token. HTTPApi needs it for deleting tokens.
+type TokenDeleter interface {
+	DeleteToken(token string) error
+}
+
+// deleteToken removes the data of token, along with the views, access
+// and onetime tokens derived from it. Only the token itself may do so,
+// not a token derived from it.
+func (h *HTTPApi) deleteToken(w http.ResponseWriter, token string) {
+	deleter, ok := h.be.(TokenDeleter)
+	if !ok {
+		notImplemented(w, "deleting tokens")
+		return
+	}
+
+	root, _, ok := h.admin(w, token)
+	if !ok {
+		return
+	}
+
+	if root != token {
+		http.Error(w, "only the token itself can delete it", 403)
+		return
+	}
+
+	derived := []struct{ space, list string }{
+		{"views", "viewlist"},
+		{"access", "accesslist"},
+	}
+
+	for _, d := range derived {
+		val, err := h.be.Get("_", d.list, token)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		children, _ := val.(map[string]interface{})
+
+		for child := range children {
+			err = h.be.Set("_", d.space, child, nil)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			// Whatever child minted is in these lists too, so only the
+			// note of it is left to drop.
+			if d.space == "access" {
+				err = h.be.Set("_", "minted", child, nil)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+			}
+		}
+
+		err = h.be.Set("_", d.list, token, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	val, err := h.be.Get("_", "onetime", "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	onetime, _ := val.(map[string]interface{})
+
+	for child, parent := range onetime {
+		if parent != token {
+			continue
+		}
+
+		err = h.be.Set("_", "onetime", child, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	var spaces []string
+
+	// Without a Lister, watches of the spaces wake when they time out.
+	if lister, ok := h.be.(Lister); ok && !h.published {
+		spaces, err = lister.List(token)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	err = deleter.DeleteToken(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	for _, space := range spaces {
+		h.hub.notify(token, space)
+	}
+}
@@ -1,29 +1,283 @@
 package datum
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
+var ErrInvalidName = errors.New("invalid token or space name")
+
 type DiskStore struct {
 	Root string
+
+	// Hashed stores blobs under the SHA-256 of their token and space
+	// rather than the names themselves.
+	Hashed bool
+
+	lock sync.Mutex
 }
 
 func NewDiskStore(root string) *DiskStore {
-	return &DiskStore{root}
+	return &DiskStore{Root: root}
 }
 
-func (d *DiskStore) Set(token, space string, val []byte) error {
+// NewHashedDiskStore returns a DiskStore that never uses a token or space
+// as a path, only hashes of them.
+func NewHashedDiskStore(root string) *DiskStore {
+	return &DiskStore{Root: root, Hashed: true}
+}
+
+// path returns the directory for a token and the file for a space in it.
+func (d *DiskStore) path(token, space string) (string, string, error) {
+	if d.Hashed {
+		token, space = hashName(token), hashName(space)
+	} else if !safePathName(token) || !safePathName(space) {
+		return "", "", ErrInvalidName
+	}
+
 	dir := filepath.Join(d.Root, token)
-	os.MkdirAll(dir, 0755)
 
-	return ioutil.WriteFile(filepath.Join(d.Root, token, space), val, 0644)
+	return dir, filepath.Join(dir, space), nil
+}
+
+func hashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// safePathName reports if name can be used as a single path element
+// without leaving its directory.
+func safePathName(name string) bool {
+	switch name {
+	case "", ".", "..":
+		return false
+	}
+
+	return !strings.ContainsAny(name, "/\\\x00")
+}
+
+func (d *DiskStore) Set(token, space string, val []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.set(token, space, val)
+}
+
+func (d *DiskStore) CompareAndSet(token, space string, old, val []byte) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	cur, err := d.Get(token, space)
+	if err != nil {
+		return false, err
+	}
+
+	if (cur == nil) != (old == nil) || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+
+	return true, d.set(token, space, val)
+}
+
+// Files being written are given this prefix until they're complete.
+const diskTempPrefix = ".datum-tmp-"
+
+// set writes val to a temporary file and renames it over the blob, so a
+// crash leaves either the old blob or the new one, never a partial one.
+func (d *DiskStore) set(token, space string, val []byte) error {
+	dir, file, err := d.path(token, space)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	if d.Hashed {
+		err = d.writeName(dir, file, space)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeAtomic(dir, file, val)
+}
+
+// Hashed blobs have their space's name kept beside them, so List can
+// return it.
+const diskNameSuffix = ".name"
+
+func (d *DiskStore) writeName(dir, file, space string) error {
+	_, err := os.Stat(file + diskNameSuffix)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeAtomic(dir, file+diskNameSuffix, []byte(space))
+}
+
+func (d *DiskStore) Delete(token, space string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dir, file, err := d.path(token, space)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if d.Hashed {
+		err = os.Remove(file + diskNameSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Drop the token's dir once it's empty, which fails until then.
+	os.Remove(dir)
+
+	return nil
+}
+
+func (d *DiskStore) List(token string) ([]string, error) {
+	dir, _, err := d.path(token, "_")
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var spaces []string
+
+	for _, info := range infos {
+		name := info.Name()
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, diskTempPrefix) {
+			continue
+		}
+
+		if !d.Hashed {
+			spaces = append(spaces, name)
+			continue
+		}
+
+		// Blobs written before names were kept can't be listed.
+		if !strings.HasSuffix(name, diskNameSuffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		spaces = append(spaces, string(data))
+	}
+
+	return spaces, nil
+}
+
+// writeAtomic writes val to file, in dir, by way of a temporary file.
+func writeAtomic(dir, file string, val []byte) error {
+	tmp, err := ioutil.TempFile(dir, diskTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(val)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory so that renames within it are durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// RemoveTemp deletes the temporary files left behind by writes that were
+// interrupted, such as by a crash. It should be called at startup, before
+// the store is used, and returns the files it removed.
+func (d *DiskStore) RemoveTemp() ([]string, error) {
+	var removed []string
+
+	err := filepath.Walk(d.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.Mode().IsRegular() && strings.HasPrefix(info.Name(), diskTempPrefix) {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+
+			removed = append(removed, path)
+		}
+
+		return nil
+	})
+
+	return removed, err
 }
 
 func (d *DiskStore) Get(token, space string) ([]byte, error) {
-	data, err := ioutil.ReadFile(filepath.Join(d.Root, token, space))
+	_, file, err := d.path(token, space)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		if strings.Contains(err.Error(), "no such file") {
 			return nil, nil
@@ -31,6 +31,10 @@ func TestDiskStore(t *testing.T) {
 		os.RemoveAll(dir)
 	})
 
+	testBlobStore(t, n, func() BlobStore {
+		return disk
+	})
+
 	n.It("stores blobs in directories", func() {
 		err := disk.Set("aabbcc", "default", []byte("foo"))
 		require.NoError(t, err)
@@ -54,5 +58,85 @@ func TestDiskStore(t *testing.T) {
 		assert.Equal(t, []byte("foo"), data)
 	})
 
+	n.It("leaves no temporary files behind", func() {
+		err := disk.Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		err = disk.Set("aabbcc", "default", []byte("bar"))
+		require.NoError(t, err)
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "aabbcc"))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(files))
+		assert.Equal(t, "default", files[0].Name())
+	})
+
+	n.It("removes temporary files from interrupted writes", func() {
+		tokenDir := filepath.Join(dir, "aabbcc")
+		os.MkdirAll(tokenDir, 0755)
+
+		err := ioutil.WriteFile(filepath.Join(tokenDir, "default"), []byte("foo"), 0644)
+		require.NoError(t, err)
+
+		stale := filepath.Join(tokenDir, diskTempPrefix+"1234")
+
+		err = ioutil.WriteFile(stale, []byte("fo"), 0644)
+		require.NoError(t, err)
+
+		removed, err := disk.RemoveTemp()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{stale}, removed)
+
+		data, err := disk.Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+	})
+
+	n.It("refuses names that would leave the config dir", func() {
+		err := disk.Set("..", "default", []byte("foo"))
+		assert.Equal(t, ErrInvalidName, err)
+
+		err = disk.Set("aabbcc", "../../etc", []byte("foo"))
+		assert.Equal(t, ErrInvalidName, err)
+
+		_, err = disk.Get("aabbcc", "..")
+		assert.Equal(t, ErrInvalidName, err)
+	})
+
+	n.It("can store blobs under hashed names", func() {
+		disk.Hashed = true
+
+		err := disk.Set("..", "../default", []byte("foo"))
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, hashName(".."), hashName("../default")))
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+
+		data, err = disk.Get("..", "../default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+	})
+
+	n.It("lists spaces stored under hashed names", func() {
+		disk.Hashed = true
+
+		err := disk.Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		err = disk.Set("aabbcc", "default", []byte("bar"))
+		require.NoError(t, err)
+
+		spaces, err := disk.List("aabbcc")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"default"}, spaces)
+	})
+
 	n.Meow()
 }
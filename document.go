@@ -0,0 +1,110 @@
+package datum
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// mergeDocument deep merges src into dst as a JSON Merge Patch (RFC 7396)
+// would: maps are merged key by key, nil values delete keys and anything
+// else replaces what was there.
+func mergeDocument(dst, src map[string]interface{}) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case nil:
+			delete(dst, k)
+		case map[string]interface{}:
+			sub, ok := dst[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+			}
+
+			mergeDocument(sub, v)
+
+			dst[k] = sub
+		default:
+			dst[k] = v
+		}
+	}
+}
+
+// scalarString formats a value that isn't a map or list as a string, with
+// encrypted values base64 encoded.
+func scalarString(val interface{}) string {
+	if encVal, ok := val.(EncryptedValue); ok {
+		return base64.StdEncoding.EncodeToString(encVal.Value)
+	}
+
+	return fmt.Sprint(val)
+}
+
+// MarshalYAML renders an EncryptedValue as encoding/json does, with the
+// value base64 encoded.
+func (e EncryptedValue) MarshalYAML() (interface{}, error) {
+	return map[string]interface{}{
+		"keyid": e.Keyid,
+		"value": base64.StdEncoding.EncodeToString(e.Value),
+	}, nil
+}
+
+// Updater is implemented by Backends that can write a whole document at
+// once. HTTPApi needs it for uploading documents and merge patches.
+type Updater interface {
+	Update(writer string, token string, space string, doc map[string]interface{}, merge bool, cond *Precondition) error
+}
+
+// putDocument stores a whole document uploaded to a space, replacing the
+// one there or, with ?merge=true, merging into it.
+func (h *HTTPApi) putDocument(token, space string, w http.ResponseWriter, req *http.Request) {
+	ext := filepath.Ext(space)
+	space = space[:len(space)-len(ext)]
+
+	updater, ok := h.be.(Updater)
+	if !ok {
+		notImplemented(w, "whole documents")
+		return
+	}
+
+	writer := token
+
+	token, ok = h.authorize(w, token, space, "", CapWrite)
+	if !ok {
+		return
+	}
+
+	// Without a Content-Type or extension there's nothing to say what the
+	// document is.
+	codec := h.requestCodec(w, req, ext, nil)
+	if codec == nil {
+		return
+	}
+
+	val, err := codec.Decoder.Decode(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	doc, ok := val.(map[string]interface{})
+	if !ok {
+		http.Error(w, "document is not a map", 400)
+		return
+	}
+
+	merge, _ := strconv.ParseBool(req.URL.Query().Get("merge"))
+
+	err = updater.Update(writer, token, space, doc, merge, requestPrecondition(req))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.consume(writer)
+
+	if !h.published {
+		h.hub.notify(token, space)
+	}
+}
@@ -0,0 +1,199 @@
+package datum
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvOptions controls how a document is flattened into environment
+// variables.
+type EnvOptions struct {
+	// Prefix is put in front of every name.
+	Prefix string
+
+	// Separator joins the parts of a key path. It defaults to "_".
+	Separator string
+
+	// Case is upper, lower or preserve. It defaults to upper.
+	Case string
+
+	// Export starts each line with export.
+	Export bool
+}
+
+// parseEnvOptions reads EnvOptions from the prefix, sep, case and export
+// query params.
+func parseEnvOptions(params url.Values) (*EnvOptions, error) {
+	opts := &EnvOptions{
+		Prefix:    params.Get("prefix"),
+		Separator: "_",
+		Case:      "upper",
+	}
+
+	if _, ok := params["sep"]; ok {
+		opts.Separator = params.Get("sep")
+	}
+
+	if c := params.Get("case"); c != "" {
+		opts.Case = c
+	}
+
+	switch opts.Case {
+	case "upper", "lower", "preserve":
+	default:
+		return nil, &ParamError{"case must be upper, lower or preserve"}
+	}
+
+	if !isEnvName(opts.Prefix) || !isEnvName(opts.Separator) {
+		return nil, &ParamError{"prefix and sep may only contain letters, digits and _"}
+	}
+
+	if export := params.Get("export"); export != "" {
+		var err error
+
+		opts.Export, err = strconv.ParseBool(export)
+		if err != nil {
+			return nil, &ParamError{"invalid export: " + export}
+		}
+	}
+
+	return opts, nil
+}
+
+func isEnvName(s string) bool {
+	for _, r := range s {
+		if !isEnvRune(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isEnvRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// EnvConflictError is returned when keys of a document flatten to the same
+// variable name, such as a_b and a.b both becoming A_B.
+type EnvConflictError struct {
+	Name  string
+	Paths []string
+}
+
+func (e *EnvConflictError) Error() string {
+	return fmt.Sprintf("keys %s all become %s", strings.Join(e.Paths, ", "), e.Name)
+}
+
+// renderEnv writes val as NAME='value' lines, sorted by name, which a
+// shell can eval. Maps are flattened with their key paths as names and
+// lists with the indexes of their elements. A value that isn't a map is
+// named after key. If two values would get the same name, nothing is
+// written and an *EnvConflictError is returned.
+func renderEnv(w io.Writer, key string, val interface{}, opts *EnvOptions) error {
+	vars := make(map[string]string)
+	paths := make(map[string][]string)
+
+	var path []string
+
+	if _, ok := val.(map[string]interface{}); !ok && key != "" {
+		path = strings.Split(key, ".")
+	}
+
+	flattenEnv(vars, paths, path, val, opts)
+
+	var conflict *EnvConflictError
+
+	for name, from := range paths {
+		if len(from) < 2 || (conflict != nil && conflict.Name < name) {
+			continue
+		}
+
+		sort.Strings(from)
+
+		conflict = &EnvConflictError{Name: name, Paths: from}
+	}
+
+	if conflict != nil {
+		return conflict
+	}
+
+	names := make([]string, 0, len(vars))
+
+	for name := range vars {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if opts.Export {
+			fmt.Fprint(w, "export ")
+		}
+
+		fmt.Fprintf(w, "%s=%s\n", name, shellQuote(vars[name]))
+	}
+
+	return nil
+}
+
+// flattenEnv adds the scalars in val to vars, recording in paths the key
+// paths that led to each name.
+func flattenEnv(vars map[string]string, paths map[string][]string, path []string, val interface{}, opts *EnvOptions) {
+	switch v := val.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, sub := range v {
+			flattenEnv(vars, paths, append(path[:len(path):len(path)], k), sub, opts)
+		}
+	case []interface{}:
+		for i, sub := range v {
+			flattenEnv(vars, paths, append(path[:len(path):len(path)], strconv.Itoa(i)), sub, opts)
+		}
+	default:
+		name := envName(path, opts)
+
+		vars[name] = scalarString(v)
+		paths[name] = append(paths[name], strings.Join(path, "."))
+	}
+}
+
+// envName joins path into a variable name, replacing anything a shell
+// wouldn't accept with _.
+func envName(path []string, opts *EnvOptions) string {
+	parts := make([]string, len(path))
+
+	for i, part := range path {
+		parts[i] = strings.Map(func(r rune) rune {
+			if isEnvRune(r) {
+				return r
+			}
+
+			return '_'
+		}, part)
+	}
+
+	name := opts.Prefix + strings.Join(parts, opts.Separator)
+
+	switch opts.Case {
+	case "upper":
+		name = strings.ToUpper(name)
+	case "lower":
+		name = strings.ToLower(name)
+	}
+
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// shellQuote single quotes s, so a POSIX shell takes it literally.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
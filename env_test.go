@@ -0,0 +1,127 @@
+package datum
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestEnv(t *testing.T) {
+	n := neko.Start(t)
+
+	opts := func() *EnvOptions {
+		return &EnvOptions{Separator: "_", Case: "upper"}
+	}
+
+	n.It("flattens a document into sorted variables", func() {
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"db": map[string]interface{}{
+				"host": "localhost",
+				"port": int64(5432),
+			},
+			"hosts": []interface{}{"a", "b"},
+		}
+
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "", doc, opts())
+		require.NoError(t, err)
+
+		expected := "DB_HOST='localhost'\nDB_PORT='5432'\nHOSTS_0='a'\nHOSTS_1='b'\nNAME='vektra'\n"
+
+		assert.Equal(t, expected, buf.String())
+	})
+
+	n.It("applies the prefix, separator and case", func() {
+		doc := map[string]interface{}{
+			"db": map[string]interface{}{"Host": "localhost"},
+		}
+
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "", doc, &EnvOptions{Prefix: "app__", Separator: "__", Case: "preserve", Export: true})
+		require.NoError(t, err)
+
+		assert.Equal(t, "export app__db__Host='localhost'\n", buf.String())
+	})
+
+	n.It("names a single value after its key", func() {
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "db.host", "localhost", opts())
+		require.NoError(t, err)
+
+		assert.Equal(t, "DB_HOST='localhost'\n", buf.String())
+	})
+
+	n.It("quotes values for the shell", func() {
+		doc := map[string]interface{}{
+			"msg": "it's $HOME `now`\nreally",
+		}
+
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "", doc, opts())
+		require.NoError(t, err)
+
+		assert.Equal(t, "MSG='it'\\''s $HOME `now`\nreally'\n", buf.String())
+	})
+
+	n.It("replaces characters names can't have", func() {
+		doc := map[string]interface{}{
+			"log-level": "debug",
+			"1st":       "yes",
+		}
+
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "", doc, opts())
+		require.NoError(t, err)
+
+		assert.Equal(t, "LOG_LEVEL='debug'\n_1ST='yes'\n", buf.String())
+	})
+
+	n.It("refuses keys that become the same name", func() {
+		doc := map[string]interface{}{
+			"a_b": "foo",
+			"a": map[string]interface{}{
+				"b": "bar",
+			},
+			"name": "vektra",
+		}
+
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "", doc, opts())
+
+		conflict, ok := err.(*EnvConflictError)
+		require.True(t, ok)
+
+		assert.Equal(t, "A_B", conflict.Name)
+		assert.Equal(t, []string{"a.b", "a_b"}, conflict.Paths)
+		assert.Equal(t, "", buf.String())
+	})
+
+	n.It("refuses names that only differ by case once cased", func() {
+		doc := map[string]interface{}{
+			"Host": "a",
+			"host": "b",
+		}
+
+		var buf bytes.Buffer
+
+		err := renderEnv(&buf, "", doc, opts())
+		assert.Error(t, err)
+
+		err = renderEnv(&buf, "", doc, &EnvOptions{Separator: "_", Case: "preserve"})
+		require.NoError(t, err)
+
+		assert.Equal(t, "Host='a'\nhost='b'\n", buf.String())
+	})
+
+	n.Meow()
+}
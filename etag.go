@@ -0,0 +1,99 @@
+package datum
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ETag returns the entity tag of a document or value, as returned by get.
+// It's derived from the JSON form of val, which orders map keys, so equal
+// values always have the same tag.
+func ETag(val interface{}) string {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha1.Sum(data)
+
+	return `"` + hex.EncodeToString(sum[:10]) + `"`
+}
+
+// ConditionalSetter is implemented by Backends that can make a write
+// depend on the current value. HTTPApi needs it for writes that carry
+// If-Match or If-None-Match.
+type ConditionalSetter interface {
+	SetIf(writer string, token string, space string, key string, val interface{}, cond *Precondition) error
+}
+
+// Precondition makes a write conditional on the current value, with the
+// meaning of the If-Match and If-None-Match headers. Each is a comma
+// separated list of entity tags, or *.
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// requestPrecondition returns the Precondition in the headers of req, or
+// nil if there is none.
+func requestPrecondition(req *http.Request) *Precondition {
+	cond := &Precondition{
+		IfMatch:     req.Header.Get("If-Match"),
+		IfNoneMatch: req.Header.Get("If-None-Match"),
+	}
+
+	if cond.IfMatch == "" && cond.IfNoneMatch == "" {
+		return nil
+	}
+
+	return cond
+}
+
+// Met reports if cur, the current value or nil if there is none, meets
+// the precondition.
+func (p *Precondition) Met(cur interface{}) bool {
+	var tag string
+
+	if cur != nil {
+		tag = ETag(cur)
+	}
+
+	if p.IfMatch != "" && !matchETag(p.IfMatch, tag, false) {
+		return false
+	}
+
+	if p.IfNoneMatch != "" && matchETag(p.IfNoneMatch, tag, true) {
+		return false
+	}
+
+	return true
+}
+
+// matchETag reports if header lists tag, or is *. Weak tags in header
+// only count if weak is set, as If-Match compares strongly and
+// If-None-Match weakly (RFC 7232, section 2.3.2).
+func matchETag(header, tag string, weak bool) bool {
+	if tag == "" {
+		return false
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,65 @@
+package datum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektra/neko"
+)
+
+func TestPrecondition(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("gives equal values the same tag", func() {
+		a := map[string]interface{}{"a": "foo", "b": "bar"}
+		b := map[string]interface{}{"b": "bar", "a": "foo"}
+
+		assert.Equal(t, ETag(a), ETag(b))
+		assert.NotEqual(t, ETag(a), ETag("foo"))
+	})
+
+	n.It("requires a matching tag for If-Match", func() {
+		cond := &Precondition{IfMatch: `"nope", ` + ETag("foo")}
+
+		assert.True(t, cond.Met("foo"))
+		assert.False(t, cond.Met("bar"))
+		assert.False(t, cond.Met(nil))
+	})
+
+	n.It("requires any value for If-Match *", func() {
+		cond := &Precondition{IfMatch: "*"}
+
+		assert.True(t, cond.Met("foo"))
+		assert.False(t, cond.Met(nil))
+	})
+
+	n.It("requires a different tag for If-None-Match", func() {
+		cond := &Precondition{IfNoneMatch: ETag("foo")}
+
+		assert.False(t, cond.Met("foo"))
+		assert.True(t, cond.Met("bar"))
+		assert.True(t, cond.Met(nil))
+	})
+
+	n.It("requires no value for If-None-Match *", func() {
+		cond := &Precondition{IfNoneMatch: "*"}
+
+		assert.False(t, cond.Met("foo"))
+		assert.True(t, cond.Met(nil))
+	})
+
+	n.It("doesn't let a weak tag meet If-Match", func() {
+		cond := &Precondition{IfMatch: "W/" + ETag("foo")}
+
+		assert.False(t, cond.Met("foo"))
+	})
+
+	n.It("lets a weak tag meet If-None-Match", func() {
+		cond := &Precondition{IfNoneMatch: "W/" + ETag("foo")}
+
+		assert.False(t, cond.Met("foo"))
+		assert.True(t, cond.Met("bar"))
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,478 @@
+package datum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+var ErrNoRevision = errors.New("no such revision")
+
+// DefaultMaxRevisions is how many revisions of a space MsgpackBackend
+// keeps unless told otherwise.
+const DefaultMaxRevisions = 100
+
+// Revision records one write to a space. Index is the change index the
+// write moved the space to, and Writer identifies the token that made it
+// without giving the token away.
+type Revision struct {
+	Index  uint64    `json:"index"`
+	Time   time.Time `json:"time"`
+	Writer string    `json:"writer"`
+	Key    string    `json:"key"`
+
+	// For a rollback, the revision that was restored.
+	From uint64 `json:"from,omitempty"`
+}
+
+// Historian is implemented by Backends that keep the earlier revisions of
+// a space. HTTPApi needs it for the history of a space, reads pinned to a
+// revision and rollbacks.
+type Historian interface {
+	History(token string, space string) ([]*Revision, error)
+	GetRevision(token string, space string, idx uint64, key string) (interface{}, error)
+	RevisionAt(token string, space string, t time.Time) (uint64, error)
+	Rollback(writer string, token string, space string, idx uint64) (uint64, error)
+}
+
+// Attributor is implemented by Backends that record which token made
+// each write. Without it, HTTPApi writes with Set.
+type Attributor interface {
+	SetBy(writer string, token string, space string, key string, val interface{}) error
+}
+
+// revisionRecord is how a Revision is kept in a history blob.
+type revisionRecord struct {
+	Index  uint64 `codec:"index"`
+	Time   int64  `codec:"time"`
+	Writer string `codec:"writer"`
+	Key    string `codec:"key"`
+	From   uint64 `codec:"from"`
+}
+
+// writerID identifies token in a history. It's a truncated hash, so that
+// reading the history doesn't hand out the tokens in it.
+func writerID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// historySpace names the blob listing the revisions of space.
+func historySpace(space string) string {
+	return ".history." + space
+}
+
+// revisionSpace names the blob holding the document of space as it was
+// at revision idx.
+func revisionSpace(space string, idx uint64) string {
+	return fmt.Sprintf(".rev.%s.%d", space, idx)
+}
+
+// isCompanion reports if name is one of the blobs kept next to space,
+// holding its index, history or revisions.
+func isCompanion(name, space string) bool {
+	return name == indexSpace(space) ||
+		name == historySpace(space) ||
+		strings.HasPrefix(name, ".rev."+space+".")
+}
+
+// commit stores data as the document of space in place of old, bumping
+// the change index and keeping data as the revision at the new index,
+// which is returned. rec is added to the history for it. Only the newest
+// MaxRevisions revisions are kept. The spaces of the "_" token hold the
+// tokens themselves, so they only get an index.
+//
+// If the document or its index changed since they were read, nothing is
+// stored and false is returned so the write can start over.
+func (m *MsgpackBackend) commit(rec revisionRecord, token, space string, old, data []byte) (uint64, bool, error) {
+	oldIdx, err := m.store.Get(token, indexSpace(space))
+	if err != nil {
+		return 0, false, err
+	}
+
+	idx, err := decodeIndex(oldIdx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	idx++
+
+	idxBlob, err := encodeIndex(idx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	blobs := map[string][]byte{
+		space:             data,
+		indexSpace(space): idxBlob,
+	}
+
+	var dropped []revisionRecord
+
+	if token != "_" {
+		records, err := m.readHistory(token, space)
+		if err != nil {
+			return 0, false, err
+		}
+
+		rec.Index = idx
+
+		records = append(records, rec)
+
+		if m.MaxRevisions > 0 && len(records) > m.MaxRevisions {
+			dropped = records[:len(records)-m.MaxRevisions]
+			records = records[len(dropped):]
+		}
+
+		var historyBlob []byte
+
+		err = codec.NewEncoderBytes(&historyBlob, msgpackHandle).Encode(records)
+		if err != nil {
+			return 0, false, err
+		}
+
+		blobs[revisionSpace(space, idx)] = data
+		blobs[historySpace(space)] = historyBlob
+	}
+
+	var swapped bool
+
+	if batch, ok := m.store.(BatchStore); ok {
+		expect := map[string][]byte{
+			space:             old,
+			indexSpace(space): oldIdx,
+		}
+
+		swapped, err = batch.CompareAndSetBatch(token, expect, blobs)
+	} else {
+		swapped, err = m.setInOrder(token, space, idx, old, blobs)
+	}
+
+	if err != nil || !swapped {
+		return 0, false, err
+	}
+
+	// The history no longer lists these, so nothing will read them.
+	for _, r := range dropped {
+		err = m.store.Delete(token, revisionSpace(space, r.Index))
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return idx, true, nil
+}
+
+// setInOrder stores the blobs of a write to space at revision idx for a
+// store without batches. They're set one at a time with the revision
+// first and the index last, so an interrupted write leaves at worst a
+// revision that nothing refers to yet. The document is only set if it's
+// still old, and if it isn't, nothing after it is set. That keeps writes
+// from processes sharing the store from being lost, but not their
+// history, which needs a BatchStore.
+func (m *MsgpackBackend) setInOrder(token, space string, idx uint64, old []byte, blobs map[string][]byte) (bool, error) {
+	if blob, ok := blobs[revisionSpace(space, idx)]; ok {
+		err := m.store.Set(token, revisionSpace(space, idx), blob)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	swapped, err := m.store.CompareAndSet(token, space, old, blobs[space])
+	if err != nil || !swapped {
+		return false, err
+	}
+
+	for _, name := range []string{historySpace(space), indexSpace(space)} {
+		blob, ok := blobs[name]
+		if !ok {
+			continue
+		}
+
+		err = m.store.Set(token, name, blob)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (m *MsgpackBackend) readHistory(token, space string) ([]revisionRecord, error) {
+	blob, err := m.store.Get(token, historySpace(space))
+	if err != nil {
+		return nil, err
+	}
+
+	if blob == nil {
+		return nil, nil
+	}
+
+	var records []revisionRecord
+
+	err = codec.NewDecoderBytes(blob, msgpackHandle).Decode(&records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// History returns the revisions of a space, oldest first.
+func (m *MsgpackBackend) History(token, space string) ([]*Revision, error) {
+	records, err := m.readHistory(token, space)
+	if err != nil {
+		return nil, err
+	}
+
+	var revs []*Revision
+
+	for _, r := range records {
+		revs = append(revs, &Revision{
+			Index:  r.Index,
+			Time:   time.Unix(0, r.Time),
+			Writer: r.Writer,
+			Key:    r.Key,
+			From:   r.From,
+		})
+	}
+
+	return revs, nil
+}
+
+// GetRevision is Get against the document as it was at revision idx.
+func (m *MsgpackBackend) GetRevision(token, space string, idx uint64, key string) (interface{}, error) {
+	blob, err := m.store.Get(token, revisionSpace(space, idx))
+	if err != nil {
+		return nil, err
+	}
+
+	if blob == nil {
+		return nil, ErrNoRevision
+	}
+
+	return m.lookup(blob, key)
+}
+
+// Rollback makes the document at revision idx the current one again. The
+// rollback is itself recorded as a new revision, whose index is returned.
+func (m *MsgpackBackend) Rollback(writer, token, space string, idx uint64) (uint64, error) {
+	return m.rollback(time.Now(), writer, token, space, idx)
+}
+
+// rollback is Rollback, recording the rollback as made at the time at.
+func (m *MsgpackBackend) rollback(at time.Time, writer, token, space string, idx uint64) (uint64, error) {
+	defer m.lock(token, space)()
+
+	data, err := m.store.Get(token, revisionSpace(space, idx))
+	if err != nil {
+		return 0, err
+	}
+
+	if data == nil {
+		return 0, ErrNoRevision
+	}
+
+	doc, err := m.lookup(data, "")
+	if err != nil {
+		return 0, err
+	}
+
+	rec := revisionRecord{Time: at.UnixNano(), Writer: writerID(writer), From: idx}
+
+	var newIdx uint64
+
+	for {
+		cur, err := m.store.Get(token, space)
+		if err != nil {
+			return 0, err
+		}
+
+		var ok bool
+
+		newIdx, ok, err = m.commit(rec, token, space, cur, data)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			break
+		}
+	}
+
+	m.publish(&Change{
+		Token: token,
+		Space: space,
+		Value: doc,
+		Index: newIdx,
+	})
+
+	return newIdx, nil
+}
+
+// RevisionAt returns the revision a space was at during t.
+func (m *MsgpackBackend) RevisionAt(token, space string, t time.Time) (uint64, error) {
+	records, err := m.readHistory(token, space)
+	if err != nil {
+		return 0, err
+	}
+
+	at := t.UnixNano()
+
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Time <= at {
+			return records[i].Index, nil
+		}
+	}
+
+	return 0, ErrNoRevision
+}
+
+func (h *HTTPApi) history(w http.ResponseWriter, token, space string) {
+	hist, ok := h.be.(Historian)
+	if !ok {
+		notImplemented(w, "history")
+		return
+	}
+
+	reader := token
+
+	// The history tells apart the tokens that wrote to the space, so it's
+	// only for those that could hand out tokens anyway.
+	token, ok = h.authorize(w, token, space, "", CapAdmin)
+	if !ok {
+		return
+	}
+
+	revs, err := hist.History(token, space)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.consume(reader)
+
+	if revs == nil {
+		revs = []*Revision{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revs)
+}
+
+// pinnedRevision returns the revision a get asks for with either the rev
+// or at parameter. at is a RFC 3339 time or seconds since the epoch. If
+// neither is given, pinned is false. If the request is bad, or the
+// Backend isn't a Historian, an error has been written to w and ok is
+// false.
+func (h *HTTPApi) pinnedRevision(w http.ResponseWriter, req *http.Request, token, space string) (uint64, bool, bool) {
+	query := req.URL.Query()
+
+	if query.Get("rev") == "" && query.Get("at") == "" {
+		return 0, false, true
+	}
+
+	hist, ok := h.be.(Historian)
+	if !ok {
+		notImplemented(w, "revisions")
+		return 0, false, false
+	}
+
+	if str := query.Get("rev"); str != "" {
+		rev, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return 0, false, false
+		}
+
+		return rev, true, true
+	}
+
+	if str := query.Get("at"); str != "" {
+		at, err := parseTime(str)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return 0, false, false
+		}
+
+		rev, err := hist.RevisionAt(token, space, at)
+		if err != nil {
+			writeError(w, err)
+			return 0, false, false
+		}
+
+		return rev, true, true
+	}
+
+	return 0, false, true
+}
+
+func parseTime(str string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, str)
+}
+
+func (h *HTTPApi) rollback1(w http.ResponseWriter, req *http.Request) {
+	var (
+		token = req.URL.Query().Get(":token")
+		space = req.URL.Query().Get(":space")
+	)
+
+	h.rollback(token, space, w, req)
+}
+
+func (h *HTTPApi) rollback2(w http.ResponseWriter, req *http.Request) {
+	var (
+		headerToken = req.Header.Get("Config-Token")
+		space       = req.URL.Query().Get(":space")
+	)
+
+	h.rollback(headerToken, space, w, req)
+}
+
+func (h *HTTPApi) rollback(token, space string, w http.ResponseWriter, req *http.Request) {
+	hist, ok := h.be.(Historian)
+	if !ok {
+		notImplemented(w, "rollbacks")
+		return
+	}
+
+	rev, err := strconv.ParseUint(req.URL.Query().Get("rev"), 10, 64)
+	if err != nil {
+		http.Error(w, "rev must be a revision number", 400)
+		return
+	}
+
+	writer := token
+
+	token, ok = h.authorize(w, token, space, "", CapWrite)
+	if !ok {
+		return
+	}
+
+	idx, err := hist.Rollback(writer, token, space, rev)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.consume(writer)
+
+	if !h.published {
+		h.hub.notify(token, space)
+	}
+
+	w.Header().Set("Config-Index", strconv.FormatUint(idx, 10))
+	fmt.Fprintf(w, "%d\n", idx)
+}
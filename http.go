@@ -1,16 +1,16 @@
 package datum
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"net/http"
 
 	"github.com/bmizerany/pat"
-	"github.com/vektra/go-toml"
 )
 
 type TokenGenerator interface {
@@ -31,14 +31,42 @@ type HTTPApi struct {
 	tg TokenGenerator
 	be Backend
 
-	mux *pat.PatternServeMux
+	mux    *pat.PatternServeMux
+	hub    *changeHub
+	codecs *CodecRegistry
+
+	// set when be reports its own changes to hub
+	published bool
 }
 
 func NewHTTPApi(tg TokenGenerator, be Backend) *HTTPApi {
-	h := &HTTPApi{tg, be, pat.New()}
+	h := &HTTPApi{tg: tg, be: be, mux: pat.New(), hub: newChangeHub(), codecs: NewCodecRegistry()}
+
+	if pub, ok := be.(Publisher); ok {
+		pub.Subscribe(h.hub.publish)
+		h.published = true
+	}
 
 	h.mux.Post("/create", http.HandlerFunc(h.create))
 	h.mux.Post("/create/onetime/:parent", http.HandlerFunc(h.createOntime))
+	h.mux.Post("/create/view/:parent", http.HandlerFunc(h.createView))
+	h.mux.Post("/create/access/:parent", http.HandlerFunc(h.createAccess))
+
+	h.mux.Get("/_views/:parent", http.HandlerFunc(h.listViews))
+	h.mux.Del("/_views/:parent/:view", http.HandlerFunc(h.revokeView))
+	h.mux.Get("/_access/:parent", http.HandlerFunc(h.listAccess))
+	h.mux.Del("/_access/:parent/:access", http.HandlerFunc(h.revokeAccess))
+	h.mux.Del("/_tokens/:token", http.HandlerFunc(h.delToken))
+
+	h.mux.Get("/:token/~:space/_templates/", http.HandlerFunc(h.templates1))
+	h.mux.Put("/:token/~:space/_templates/", http.HandlerFunc(h.templates1))
+	h.mux.Del("/:token/~:space/_templates/", http.HandlerFunc(h.templates1))
+	h.mux.Get("/~:space/_templates/", http.HandlerFunc(h.templates2))
+	h.mux.Put("/~:space/_templates/", http.HandlerFunc(h.templates2))
+	h.mux.Del("/~:space/_templates/", http.HandlerFunc(h.templates2))
+
+	h.mux.Post("/:token/~:space/_rollback", http.HandlerFunc(h.rollback1))
+	h.mux.Post("/~:space/_rollback", http.HandlerFunc(h.rollback2))
 
 	h.mux.Put("/:token/~:space", http.HandlerFunc(h.put3))
 	h.mux.Put("/:token/~:space/", http.HandlerFunc(h.put3))
@@ -46,12 +74,18 @@ func NewHTTPApi(tg TokenGenerator, be Backend) *HTTPApi {
 	h.mux.Put("/:key", http.HandlerFunc(h.put1))
 	h.mux.Put("/:token/", http.HandlerFunc(h.put2))
 
+	h.mux.Add("PATCH", "/:token/~:space", http.HandlerFunc(h.patch1))
+	h.mux.Add("PATCH", "/~:space", http.HandlerFunc(h.patch2))
+
 	h.mux.Del("/:token/~:space", http.HandlerFunc(h.del3))
 	h.mux.Del("/:token/~:space/", http.HandlerFunc(h.del3))
 	h.mux.Del("/~:space/", http.HandlerFunc(h.del4))
 	h.mux.Del("/:key", http.HandlerFunc(h.del1))
 	h.mux.Del("/:token/", http.HandlerFunc(h.del2))
 
+	h.mux.Get("/:token/~:space/_render/", http.HandlerFunc(h.render1))
+	h.mux.Get("/~:space/_render/", http.HandlerFunc(h.render2))
+
 	h.mux.Get("/:token/~:space", http.HandlerFunc(h.get2))
 	h.mux.Get("/:token/~:space/", http.HandlerFunc(h.get2))
 	h.mux.Get("/~:space", http.HandlerFunc(h.get3))
@@ -69,9 +103,19 @@ func (h *HTTPApi) create(w http.ResponseWriter, req *http.Request) {
 }
 
 func (h *HTTPApi) createOntime(w http.ResponseWriter, req *http.Request) {
-	token := h.tg.NewToken()
+	minter := req.URL.Query().Get(":parent")
+
+	parent, caps, ok := h.admin(w, minter)
+	if !ok {
+		return
+	}
+
+	if !caps.Read || !caps.Write || caps.Restricted() {
+		http.Error(w, "onetime tokens need unrestricted read and write", 403)
+		return
+	}
 
-	parent := req.URL.Query().Get(":parent")
+	token := h.tg.NewToken()
 
 	err := h.be.Set("_", "onetime", token, parent)
 	if err != nil {
@@ -79,9 +123,269 @@ func (h *HTTPApi) createOntime(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	err = h.recordMinted(minter, token, "onetime")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	fmt.Fprintf(w, "%s\n", token)
 }
 
+func (h *HTTPApi) createView(w http.ResponseWriter, req *http.Request) {
+	minter := req.URL.Query().Get(":parent")
+
+	parent, caps, ok := h.admin(w, minter)
+	if !ok {
+		return
+	}
+
+	if !caps.Read || caps.Restricted() {
+		http.Error(w, "views need unrestricted read", 403)
+		return
+	}
+
+	token := "v-" + h.tg.NewToken()
+
+	err := h.be.Set("_", "views", token, parent)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = h.be.Set("_", "viewlist", parent+"."+token, true)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = h.recordMinted(minter, token, "views")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", token)
+}
+
+func (h *HTTPApi) createAccess(w http.ResponseWriter, req *http.Request) {
+	minter := req.URL.Query().Get(":parent")
+
+	parent, parentCaps, ok := h.admin(w, minter)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+
+	want := &Capabilities{
+		Spaces:   query["space"],
+		Prefixes: query["prefix"],
+	}
+
+	for _, cap := range query["cap"] {
+		switch cap {
+		case "read":
+			want.Read = true
+		case "write":
+			want.Write = true
+		case "admin":
+			want.Admin = true
+		default:
+			http.Error(w, fmt.Sprintf("unknown capability: %s", cap), 400)
+			return
+		}
+	}
+
+	caps, ok := want.Within(parentCaps)
+	if !ok {
+		http.Error(w, "access exceeds that of the parent token", 403)
+		return
+	}
+
+	token := "a-" + h.tg.NewToken()
+
+	err := h.be.Set("_", "access", token, accessEntry(parent, caps))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = h.be.Set("_", "accesslist", parent+"."+token, true)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = h.recordMinted(minter, token, "access")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", token)
+}
+
+func (h *HTTPApi) listViews(w http.ResponseWriter, req *http.Request) {
+	h.listChildren(w, req, "viewlist")
+}
+
+func (h *HTTPApi) listAccess(w http.ResponseWriter, req *http.Request) {
+	h.listChildren(w, req, "accesslist")
+}
+
+func (h *HTTPApi) listChildren(w http.ResponseWriter, req *http.Request, list string) {
+	parent, _, ok := h.admin(w, req.URL.Query().Get(":parent"))
+	if !ok {
+		return
+	}
+
+	val, err := h.be.Get("_", list, parent)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	children, _ := val.(map[string]interface{})
+
+	var tokens []string
+
+	for token := range children {
+		tokens = append(tokens, token)
+	}
+
+	sort.Strings(tokens)
+
+	for _, token := range tokens {
+		fmt.Fprintf(w, "%s\n", token)
+	}
+}
+
+func (h *HTTPApi) revokeView(w http.ResponseWriter, req *http.Request) {
+	parent, _, ok := h.admin(w, req.URL.Query().Get(":parent"))
+	if !ok {
+		return
+	}
+
+	token := req.URL.Query().Get(":view")
+
+	owner, err := h.be.Get("_", "views", token)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if owner != parent {
+		http.Error(w, "no such view", 404)
+		return
+	}
+
+	h.revokeChild(w, parent, token, "views")
+}
+
+func (h *HTTPApi) revokeAccess(w http.ResponseWriter, req *http.Request) {
+	parent, _, ok := h.admin(w, req.URL.Query().Get(":parent"))
+	if !ok {
+		return
+	}
+
+	token := req.URL.Query().Get(":access")
+
+	val, err := h.be.Get("_", "access", token)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if val == nil {
+		http.Error(w, "no such access token", 404)
+		return
+	}
+
+	owner, _, err := parseAccessEntry(val)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if owner != parent {
+		http.Error(w, "no such access token", 404)
+		return
+	}
+
+	h.revokeChild(w, parent, token, "access")
+}
+
+func (h *HTTPApi) revokeChild(w http.ResponseWriter, parent, token, space string) {
+	err := h.revoke(parent, token, space)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// The lists that record the views and access tokens of a token.
+var childLists = map[string]string{
+	"views":  "viewlist",
+	"access": "accesslist",
+}
+
+// recordMinted notes that the access token minter made token, kept in
+// space, so that revoking minter revokes token too. Tokens made by the
+// owner of the data need no note, as only deleting the owner drops them.
+func (h *HTTPApi) recordMinted(minter, token, space string) error {
+	if !strings.HasPrefix(minter, "a-") {
+		return nil
+	}
+
+	return h.be.Set("_", "minted", minter+"."+token, space)
+}
+
+// revoke drops token, kept in space, that shares the data of parent,
+// along with every token made with it and the ones made with those.
+func (h *HTTPApi) revoke(parent, token, space string) error {
+	err := h.be.Set("_", space, token, nil)
+	if err != nil {
+		return err
+	}
+
+	if list, ok := childLists[space]; ok {
+		err = h.be.Set("_", list, parent+"."+token, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if space != "access" {
+		return nil
+	}
+
+	// token is gone, so it can't mint any more while these are revoked.
+	val, err := h.be.Get("_", "minted", token)
+	if err != nil {
+		return err
+	}
+
+	minted, _ := val.(map[string]interface{})
+
+	for child, childSpace := range minted {
+		childSpace, ok := childSpace.(string)
+		if !ok {
+			continue
+		}
+
+		err = h.revoke(parent, child, childSpace)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(minted) == 0 {
+		return nil
+	}
+
+	return h.be.Set("_", "minted", token, nil)
+}
+
 func (h *HTTPApi) put1(w http.ResponseWriter, req *http.Request) {
 	var (
 		headerToken = req.Header.Get("Config-Token")
@@ -134,87 +438,243 @@ func (h *HTTPApi) deleteOnetime(token string) {
 	h.be.Set("_", "onetime", token, nil)
 }
 
-func (h *HTTPApi) put(token, space, key string, w http.ResponseWriter, req *http.Request) {
-	var (
-		val interface{}
-		err error
-	)
+// consume uses up token if it's a onetime token. It's called once the
+// request made with it has succeeded, so that a request that was refused
+// or failed leaves the token to be tried again.
+func (h *HTTPApi) consume(token string) {
+	if strings.HasPrefix(token, "o-") {
+		h.deleteOnetime(token)
+	}
+}
 
-	var asJson bool
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
 
-	ext := filepath.Ext(key)
-	switch ext {
-	case "json":
-		asJson = true
+// ValidName reports if name can be used as a token or space. Names are
+// limited to letters, digits, dashes and underscores, so they are safe to
+// use in paths and leave dotted names free for a BlobStore's own use.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// authorize maps a token to the token that owns the data and checks that
+// it may use cap on key in space. Onetime tokens are left for the caller
+// to consume, views are read-only and access tokens carry their own
+// Capabilities. If the token can't be used, an error has been written to
+// w and false is returned.
+func (h *HTTPApi) authorize(w http.ResponseWriter, token, space, key string, cap Capability) (string, bool) {
+	if !checkNames(w, token, space) {
+		return "", false
 	}
 
-	asJson = req.Header.Get("Content-Type") == "application/json"
+	token, caps, ok := h.resolve(w, token, cap)
+	if !ok {
+		return "", false
+	}
 
-	if ext != "" {
-		key = key[:len(key)-len(ext)]
+	if !caps.Allows(cap, space, key) {
+		http.Error(w, "access denied", 403)
+		return "", false
 	}
 
-	key = strings.Replace(key, "/", ".", -1)
+	return token, true
+}
 
-	var body []byte
+// checkNames makes sure token and spaces are valid names and that token
+// isn't the reserved one. If not, an error has been written to w and false
+// is returned.
+func checkNames(w http.ResponseWriter, token string, spaces ...string) bool {
+	if !ValidName(token) {
+		http.Error(w, "invalid token", 400)
+		return false
+	}
 
-	if asJson {
-		err = json.NewDecoder(req.Body).Decode(&val)
-	} else {
-		body, err = ioutil.ReadAll(req.Body)
-		if err == nil {
-			val = string(body)
+	for _, space := range spaces {
+		if !ValidName(space) {
+			http.Error(w, "invalid space", 400)
+			return false
 		}
 	}
 
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	if token == "_" {
+		http.Error(w, "reserved token", 403)
+		return false
 	}
 
-	if len(token) > 2 {
-		switch token[0:2] {
-		case "o-":
-			parent, err := h.be.Get("_", "onetime", token)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			if str, ok := parent.(string); ok {
-				defer h.deleteOnetime(token)
-
-				token = str
-			} else {
-				http.Error(w, "corrupt view mapping", 500)
-				return
-			}
-		case "v-":
-			parent, err := h.be.Get("_", "views", token)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			if str, ok := parent.(string); ok {
-				token = str
-			} else {
-				http.Error(w, "corrupt view mapping", 500)
-				return
-			}
+	return true
+}
+
+// The rights of a view token.
+var viewCapabilities = &Capabilities{Read: true}
+
+// resolve is the part of authorize that maps a valid token to the token
+// that owns the data, returning its Capabilities too.
+func (h *HTTPApi) resolve(w http.ResponseWriter, token string, cap Capability) (string, *Capabilities, bool) {
+	if len(token) <= 2 {
+		return token, FullCapabilities, true
+	}
+
+	switch token[0:2] {
+	case "o-":
+		parent, err := h.be.Get("_", "onetime", token)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return "", nil, false
+		}
+
+		if str, ok := parent.(string); ok {
+			return str, FullCapabilities, true
 		}
+
+		http.Error(w, "corrupt view mapping", 500)
+		return "", nil, false
+	case "v-":
+		if cap != CapRead {
+			http.Error(w, "views are read-only", 403)
+			return "", nil, false
+		}
+
+		parent, err := h.be.Get("_", "views", token)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return "", nil, false
+		}
+
+		if str, ok := parent.(string); ok {
+			return str, viewCapabilities, true
+		}
+
+		http.Error(w, "corrupt view mapping", 500)
+		return "", nil, false
+	case "a-":
+		val, err := h.be.Get("_", "access", token)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return "", nil, false
+		}
+
+		if val == nil {
+			http.Error(w, "unknown access token", 403)
+			return "", nil, false
+		}
+
+		parent, caps, err := parseAccessEntry(val)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return "", nil, false
+		}
+
+		return parent, caps, true
+	}
+
+	return token, FullCapabilities, true
+}
+
+// admin checks that token may manage the tokens derived from its data,
+// returning the token that owns the data and the rights of token.
+func (h *HTTPApi) admin(w http.ResponseWriter, token string) (string, *Capabilities, bool) {
+	if !checkNames(w, token) {
+		return "", nil, false
+	}
+
+	if len(token) <= 2 {
+		return token, FullCapabilities, true
 	}
 
+	switch token[0:2] {
+	case "o-", "v-":
+		http.Error(w, "admin rights required", 403)
+		return "", nil, false
+	case "a-":
+		val, err := h.be.Get("_", "access", token)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return "", nil, false
+		}
+
+		if val == nil {
+			http.Error(w, "unknown access token", 403)
+			return "", nil, false
+		}
+
+		parent, caps, err := parseAccessEntry(val)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return "", nil, false
+		}
+
+		if !caps.Admin {
+			http.Error(w, "admin rights required", 403)
+			return "", nil, false
+		}
+
+		return parent, caps, true
+	}
+
+	return token, FullCapabilities, true
+}
+
+func (h *HTTPApi) put(token, space, key string, w http.ResponseWriter, req *http.Request) {
+	var (
+		val interface{}
+		err error
+	)
+
+	if key == "" {
+		h.putDocument(token, space, w, req)
+		return
+	}
+
+	key, ext := h.keyExt(key)
+
+	key = strings.Replace(key, "/", ".", -1)
+
+	cond := requestPrecondition(req)
+	if !h.canSet(w, cond) {
+		return
+	}
+
+	writer := token
+
+	token, ok := h.authorize(w, token, space, key, CapWrite)
+	if !ok {
+		return
+	}
+
+	// Encrypted values are stored as they come, whatever their format.
 	if keyid := req.Header.Get("Config-Encryption-KeyID"); keyid != "" {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
 		val = &EncryptedValue{
 			Value: body,
 			Keyid: keyid,
 		}
+	} else {
+		codec := h.requestCodec(w, req, ext, h.codecs.Default())
+		if codec == nil {
+			return
+		}
+
+		val, err = codec.Decoder.Decode(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 	}
 
-	err = h.be.Set(token, space, key, val)
+	err = h.setValue(writer, token, space, key, val, cond)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, err)
+		return
+	}
+
+	h.consume(writer)
+
+	if !h.published {
+		h.hub.notify(token, space)
 	}
 }
 
@@ -227,6 +687,10 @@ func (h *HTTPApi) del1(w http.ResponseWriter, req *http.Request) {
 	h.del(headerToken, "default", key, w, req)
 }
 
+func (h *HTTPApi) delToken(w http.ResponseWriter, req *http.Request) {
+	h.deleteToken(w, req.URL.Query().Get(":token"))
+}
+
 func (h *HTTPApi) del2(w http.ResponseWriter, req *http.Request) {
 	var (
 		headerToken = req.Header.Get("Config-Token")
@@ -269,9 +733,41 @@ func (h *HTTPApi) del4(w http.ResponseWriter, req *http.Request) {
 func (h *HTTPApi) del(token, space, key string, w http.ResponseWriter, req *http.Request) {
 	key = strings.Replace(key, "/", ".", -1)
 
-	err := h.be.Set(token, space, key, nil)
+	cond := requestPrecondition(req)
+	if !h.canSet(w, cond) {
+		return
+	}
+
+	deleter, ok := h.be.(SpaceDeleter)
+	if key == "" && !ok {
+		notImplemented(w, "deleting spaces")
+		return
+	}
+
+	writer := token
+
+	token, ok = h.authorize(w, token, space, key, CapWrite)
+	if !ok {
+		return
+	}
+
+	var err error
+
+	if key == "" {
+		err = deleter.DeleteSpace(token, space, cond)
+	} else {
+		err = h.setValue(writer, token, space, key, nil, cond)
+	}
+
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, err)
+		return
+	}
+
+	h.consume(writer)
+
+	if !h.published {
+		h.hub.notify(token, space)
 	}
 }
 
@@ -335,65 +831,90 @@ func (h *HTTPApi) get(token, space, key string, w http.ResponseWriter, req *http
 		space = "default"
 	}
 
-	var asToml bool
-
-	asJson := req.Header.Get("Accept") == "application/json"
-
-	var ext string
+	var (
+		ext      string
+		fallback *Codec
+	)
 
+	// Whole spaces need a format that can describe them, but any single
+	// value can be read as text.
 	if key == "" {
 		ext = filepath.Ext(space)
 		space = space[:len(space)-len(ext)]
 	} else {
-		ext = filepath.Ext(key)
-		key = key[:len(key)-len(ext)]
+		key, ext = h.keyExt(key)
+		key = strings.Replace(key, "/", ".", -1)
+		fallback = h.codecs.Default()
 	}
 
-	switch ext {
-	case ".json":
-		asJson = true
-	case ".toml":
-		asToml = true
+	codec := h.responseCodec(w, req, ext, fallback)
+	if codec == nil {
+		return
 	}
 
-	key = strings.Replace(key, "/", ".", -1)
+	if !h.sync(w, req) {
+		return
+	}
+
+	if key == "_history" {
+		h.history(w, token, space)
+		return
+	}
+
+	if key == "_spaces" {
+		h.spaces(w, token, codec)
+		return
+	}
+
+	reader := token
+
+	token, ok := h.authorize(w, token, space, key, CapRead)
+	if !ok {
+		return
+	}
+
+	if req.URL.Query().Get("stream") == "sse" {
+		// Without a Publisher, nothing feeds the hub's streams.
+		if !h.published {
+			notImplemented(w, "streams")
+			return
+		}
+
+		h.consume(reader)
 
-	if len(token) > 2 {
-		switch token[0:2] {
-		case "o-":
-			parent, err := h.be.Get("_", "onetime", token)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			if str, ok := parent.(string); ok {
-				defer h.deleteOnetime(token)
-
-				token = str
-			} else {
-				http.Error(w, "corrupt view mapping", 500)
-				return
-			}
-		case "v-":
-			parent, err := h.be.Get("_", "views", token)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			if str, ok := parent.(string); ok {
-				token = str
-			} else {
-				http.Error(w, "corrupt view mapping", 500)
-				return
-			}
+		h.stream(w, req, token, space, key, codec)
+		return
+	}
+
+	if wait := req.URL.Query().Get("wait"); wait != "" {
+		if !h.watch(w, req, token, space, key, wait) {
+			return
 		}
 	}
 
-	val, err := h.be.Get(token, space, key)
+	var (
+		val interface{}
+		err error
+	)
+
+	if rev, pinned, ok := h.pinnedRevision(w, req, token, space); !ok {
+		return
+	} else if pinned {
+		val, err = h.be.(Historian).GetRevision(token, space, rev, key)
+	} else {
+		val, err = h.be.Get(token, space, key)
+	}
+
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, err)
+		return
+	}
+
+	h.consume(reader)
+
+	if _, ok := req.URL.Query()["keys"]; ok {
+		renderList(w, keyPaths(key, val), codec)
+		return
 	}
 
 	if val == nil {
@@ -401,27 +922,70 @@ func (h *HTTPApi) get(token, space, key string, w http.ResponseWriter, req *http
 		return
 	}
 
+	w.Header().Set("ETag", ETag(val))
+
 	if encVal, ok := val.(EncryptedValue); ok {
 		w.Header().Set("Config-Encryption-KeyID", encVal.Keyid)
 	}
 
-	if mapVal, ok := val.(map[string]interface{}); ok {
-		if asToml {
-			tree := toml.TreeFromMap(mapVal)
-			fmt.Fprintf(w, "%s", tree.ToString())
-		} else {
-			json.NewEncoder(w).Encode(mapVal)
-		}
-	} else {
-		if asJson {
-			json.NewEncoder(w).Encode(val)
-		} else {
-			if encVal, ok := val.(EncryptedValue); ok {
-				w.Write(encVal.Value)
-			} else {
-				fmt.Fprintf(w, "%s\n", val)
-			}
-		}
+	writeEncoded(w, codec, key, val, req.URL.Query())
+}
+
+// canSet checks that the Backend can make a write depend on cond, writing
+// a 501 and returning false if not.
+func (h *HTTPApi) canSet(w http.ResponseWriter, cond *Precondition) bool {
+	if _, ok := h.be.(ConditionalSetter); cond != nil && !ok {
+		notImplemented(w, "preconditions")
+		return false
+	}
+
+	return true
+}
+
+// setValue stores val at key in space, recording writer as the one who
+// wrote it if the Backend keeps track. If cond is given, the current value
+// must meet it, which canSet has checked the Backend can do.
+func (h *HTTPApi) setValue(writer, token, space, key string, val interface{}, cond *Precondition) error {
+	if cond != nil {
+		return h.be.(ConditionalSetter).SetIf(writer, token, space, key, val, cond)
+	}
+
+	if attr, ok := h.be.(Attributor); ok {
+		return attr.SetBy(writer, token, space, key, val)
+	}
+
+	return h.be.Set(token, space, key, val)
+}
+
+// notImplemented reports that the Backend can't do what a request needs.
+func notImplemented(w http.ResponseWriter, what string) {
+	http.Error(w, "backend does not support "+what, 501)
+}
+
+// writeError reports err with the status that the well known backend
+// errors map to.
+func writeError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *PatchError:
+		http.Error(w, err.Error(), 409)
+		return
+	case *ParamError:
+		http.Error(w, err.Error(), 400)
+		return
+	case *EnvConflictError:
+		http.Error(w, err.Error(), 409)
+		return
+	}
+
+	switch err {
+	case ErrNoRevision:
+		http.Error(w, err.Error(), 404)
+	case ErrPreconditionFailed:
+		http.Error(w, err.Error(), 412)
+	case ErrNoLeader, ErrSyncTimeout:
+		http.Error(w, err.Error(), 503)
+	default:
+		http.Error(w, err.Error(), 500)
 	}
 }
 
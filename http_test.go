@@ -2,11 +2,16 @@ package datum
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -70,7 +75,7 @@ func TestHTTP(t *testing.T) {
 		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah", strings.NewReader("foo"))
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "def", "blah", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -83,7 +88,7 @@ func TestHTTP(t *testing.T) {
 		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah/bar", strings.NewReader("foo"))
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "def", "blah.bar", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah.bar", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -98,7 +103,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Add("Content-Type", "application/json")
 
-		be.On("Set", "aabbcc", "def", "blah", 1).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", 1).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -232,11 +237,164 @@ func TestHTTP(t *testing.T) {
 		assert.Equal(t, expected, w.Body.String())
 	})
 
+	n.It("can return a tree in YAML if requested", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah.yaml", nil)
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"bar": map[string]interface{}{
+				"qux": "foo",
+			},
+			"list": []interface{}{int64(1), int64(2)},
+		}
+
+		be.On("Get", "aabbcc", "def", "blah").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		expected := "bar:\n  qux: foo\nlist:\n- 1\n- 2\n"
+
+		assert.Equal(t, expected, w.Body.String())
+	})
+
+	n.It("can return a space in YAML given an Accept header", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Accept", "application/yaml")
+
+		doc := map[string]interface{}{
+			"bar": "foo",
+		}
+
+		be.On("Get", "aabbcc", "def", "").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "bar: foo\n", w.Body.String())
+	})
+
+	n.It("can add a key as yaml", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah.yml", strings.NewReader("qux: foo\nlist: [a, b]\n"))
+		require.NoError(t, err)
+
+		val := map[string]interface{}{
+			"qux":  "foo",
+			"list": []interface{}{"a", "b"},
+		}
+
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", val).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("can return a space as environment variables", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def.env?prefix=app_&case=lower", nil)
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"db": map[string]interface{}{
+				"host": "localhost",
+			},
+		}
+
+		be.On("Get", "aabbcc", "def", "").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "app_db_host='localhost'\n", w.Body.String())
+	})
+
+	n.It("rejects invalid environment variable options", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def.env?sep=.", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "aabbcc", "def", "").Return(map[string]interface{}{"blah": "foo"}, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("refuses a space whose keys become the same variable", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def.env", nil)
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"a_b": "foo",
+			"a": map[string]interface{}{
+				"b": "bar",
+			},
+		}
+
+		be.On("Get", "aabbcc", "def", "").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 409, w.Code)
+		assert.Contains(t, w.Body.String(), "a.b, a_b")
+	})
+
+	n.It("can return a space as a properties file", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def.properties", nil)
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"db": map[string]interface{}{
+				"host": "localhost",
+			},
+		}
+
+		be.On("Get", "aabbcc", "def", "").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "db.host=localhost\n", w.Body.String())
+	})
+
+	n.It("replaces a space with an ini file", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def.ini", strings.NewReader("[db]\nhost = localhost\n"))
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"db": map[string]interface{}{"host": "localhost"},
+		}
+
+		be.On("Update", "aabbcc", "aabbcc", "def", doc, false, (*Precondition)(nil)).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
 	n.It("sets a default space if none specified", func() {
 		req, err := http.NewRequest("PUT", "/aabbcc/blah", strings.NewReader("foo"))
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "default", "blah", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -251,7 +409,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "default", "blah", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -266,7 +424,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "default", "blah.bar", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah.bar", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -281,7 +439,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "here", "blah", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "here", "blah", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -296,7 +454,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "here", "blah.bar", "foo").Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "here", "blah.bar", "foo").Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -428,7 +586,7 @@ func TestHTTP(t *testing.T) {
 		req, err := http.NewRequest("DELETE", "/aabbcc/~def/blah", nil)
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "def", "blah", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -441,7 +599,7 @@ func TestHTTP(t *testing.T) {
 		req, err := http.NewRequest("DELETE", "/aabbcc/~def/blah/bar", nil)
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "def", "blah.bar", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah.bar", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -454,7 +612,7 @@ func TestHTTP(t *testing.T) {
 		req, err := http.NewRequest("DELETE", "/aabbcc/blah", nil)
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "default", "blah", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -467,7 +625,7 @@ func TestHTTP(t *testing.T) {
 		req, err := http.NewRequest("DELETE", "/aabbcc/blah/bar", nil)
 		require.NoError(t, err)
 
-		be.On("Set", "aabbcc", "default", "blah.bar", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah.bar", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -482,7 +640,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "def", "blah", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -497,7 +655,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "def", "blah.bar", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah.bar", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -512,7 +670,7 @@ func TestHTTP(t *testing.T) {
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "default", "blah", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -521,13 +679,24 @@ func TestHTTP(t *testing.T) {
 		assert.Equal(t, 200, w.Code)
 	})
 
+	n.It("doesn't delete a token for a key delete without a header token", func() {
+		req, err := http.NewRequest("DELETE", "/aabbcc", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
 	n.It("can delete a subtree key to a doc with a header token in default", func() {
 		req, err := http.NewRequest("DELETE", "/blah/bar", nil)
 		require.NoError(t, err)
 
 		req.Header.Set("Config-Token", "aabbcc")
 
-		be.On("Set", "aabbcc", "default", "blah.bar", nil).Return(nil)
+		be.On("SetBy", "aabbcc", "aabbcc", "default", "blah.bar", nil).Return(nil)
 
 		w := httptest.NewRecorder()
 
@@ -557,135 +726,1365 @@ func TestHTTP(t *testing.T) {
 		assert.Equal(t, expected, w.Body.String())
 	})
 
-	n.It("maps view tokens to their parent on get", func() {
-		req, err := http.NewRequest("GET", "/v-ddeeff/~def/bar", nil)
+	n.It("returns the change index when watching without an index", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?wait=1s", nil)
 		require.NoError(t, err)
 
-		be.On("Get", "_", "views", "v-ddeeff").Return("aabbcc", nil)
-
-		be.On("Get", "aabbcc", "def", "bar").Return("foo", nil)
+		be.On("Index", "aabbcc", "def").Return(uint64(3), nil)
+		be.On("Get", "aabbcc", "def", "blah").Return("foo", nil)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
 		assert.Equal(t, 200, w.Code)
-
+		assert.Equal(t, "3", w.Header().Get("Config-Index"))
 		assert.Equal(t, "foo\n", w.Body.String())
 	})
 
-	n.It("maps view tokens to their parent on set", func() {
-		req, err := http.NewRequest("PUT", "/v-ddeeff/~def/bar", strings.NewReader("foo"))
+	n.It("returns at once when watching an older index", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def?wait=1s&index=2", nil)
 		require.NoError(t, err)
 
-		be.On("Get", "_", "views", "v-ddeeff").Return("aabbcc", nil)
+		doc := map[string]interface{}{"blah": "foo"}
 
-		be.On("Set", "aabbcc", "def", "bar", "foo").Return(nil)
+		be.On("Index", "aabbcc", "def").Return(uint64(3), nil)
+		be.On("Get", "aabbcc", "def", "").Return(doc, nil)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
 		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "3", w.Header().Get("Config-Index"))
+		assert.Equal(t, `{"blah":"foo"}`+"\n", w.Body.String())
 	})
 
-	n.It("deletes one-time tokens on first get", func() {
-		req, err := http.NewRequest("GET", "/o-ddeeff/~def/bar", nil)
+	n.It("times out a watch with a 304", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def?wait=10ms&index=3", nil)
 		require.NoError(t, err)
 
-		be.On("Get", "_", "onetime", "o-ddeeff").Return("aabbcc", nil)
-		be.On("Set", "_", "onetime", "o-ddeeff", nil).Return(nil)
-
-		be.On("Get", "aabbcc", "def", "bar").Return("foo", nil)
+		be.On("Index", "aabbcc", "def").Return(uint64(3), nil)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
-		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 304, w.Code)
+		assert.Equal(t, "3", w.Header().Get("Config-Index"))
+	})
 
-		assert.Equal(t, "foo\n", w.Body.String())
+	n.It("wakes a watch when the space changes", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?wait=5s&index=3", nil)
+		require.NoError(t, err)
+
+		be.On("Index", "aabbcc", "def").Return(uint64(3), nil).Once()
+		be.On("Get", "aabbcc", "def", "blah").Return("foo", nil).Once()
+		be.On("Index", "aabbcc", "def").Return(uint64(4), nil)
+		be.On("Get", "aabbcc", "def", "blah").Return("bar", nil)
+
+		w := httptest.NewRecorder()
+
+		done := make(chan struct{})
+
+		go func() {
+			h.ServeHTTP(w, req)
+			close(done)
+		}()
+
+		for {
+			h.hub.notify("aabbcc", "def")
+
+			select {
+			case <-done:
+			case <-time.After(10 * time.Millisecond):
+				continue
+			}
+
+			break
+		}
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "4", w.Header().Get("Config-Index"))
+		assert.Equal(t, "bar\n", w.Body.String())
 	})
 
-	n.It("deletes one-time tokens on first set", func() {
-		req, err := http.NewRequest("PUT", "/o-ddeeff/~def/bar", strings.NewReader("foo"))
+	n.It("rejects a bad wait duration", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def?wait=soon", nil)
 		require.NoError(t, err)
 
-		be.On("Get", "_", "onetime", "o-ddeeff").Return("aabbcc", nil)
-		be.On("Set", "_", "onetime", "o-ddeeff", nil).Return(nil)
+		w := httptest.NewRecorder()
 
-		be.On("Set", "aabbcc", "def", "bar", "foo").Return(nil)
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("rejects an unknown consistency", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?consistency=always", nil)
+		require.NoError(t, err)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
-		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 400, w.Code)
 	})
 
-	n.It("records an encrypted value along with the keyid", func() {
-		req, err := http.NewRequest("PUT", "/aabbcc/~def/bar", strings.NewReader("foo"))
+	n.It("streams changes to a space as server-sent events", func() {
+		h = NewHTTPApi(&tg, publishingBackend{&be})
+
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?stream=sse", nil)
 		require.NoError(t, err)
 
-		req.Header.Set("Config-Encryption-KeyID", "a1b2c3")
+		be.On("Get", "aabbcc", "def", "blah").Return("foo", nil)
 
-		encVal := &EncryptedValue{
-			Value: []byte("foo"),
-			Keyid: "a1b2c3",
+		w := httptest.NewRecorder()
+
+		done := make(chan struct{})
+
+		go func() {
+			h.ServeHTTP(w, req)
+			close(done)
+		}()
+
+		var stream chan *Change
+
+		for stream == nil {
+			h.hub.Lock()
+			for ch := range h.hub.streams["aabbcc/def"] {
+				stream = ch
+			}
+			h.hub.Unlock()
+
+			time.Sleep(time.Millisecond)
 		}
 
-		be.On("Set", "aabbcc", "def", "bar", encVal).Return(nil)
+		h.hub.publish(&Change{Token: "aabbcc", Space: "def", Key: "blah.bar", Value: "foo", Index: 4})
+		h.hub.publish(&Change{Token: "aabbcc", Space: "def", Key: "other", Value: "foo", Index: 5})
+		h.hub.publish(&Change{Token: "aabbcc", Space: "def", Key: "blah", Index: 6})
+
+		h.hub.unsubscribe("aabbcc", "def", stream)
+
+		<-done
+
+		expected := "event: set\nid: 4\ndata: blah.bar\ndata: foo\n\n" +
+			"event: delete\nid: 6\ndata: blah\n\n"
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		assert.Equal(t, expected, w.Body.String())
+	})
+
+	n.It("returns 501 for a stream from a backend that doesn't publish", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?stream=sse", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 501, w.Code)
+	})
+
+	n.It("can retrieve a key from an old revision", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?rev=3", nil)
+		require.NoError(t, err)
+
+		be.On("GetRevision", "aabbcc", "def", uint64(3), "blah").Return("foo", nil)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
 		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "foo\n", w.Body.String())
 	})
 
-	n.It("returns an encrypted value along with the keyid", func() {
-		req, err := http.NewRequest("GET", "/aabbcc/~def/bar", nil)
+	n.It("can retrieve a space as it was at a time", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def?at=2015-01-02T15:04:05Z", nil)
 		require.NoError(t, err)
 
-		encVal := EncryptedValue{
-			Value: []byte("foo"),
-			Keyid: "a1b2c3",
-		}
+		at := time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC)
 
-		be.On("Get", "aabbcc", "def", "bar").Return(encVal, nil)
+		doc := map[string]interface{}{"blah": "foo"}
+
+		be.On("RevisionAt", "aabbcc", "def", at).Return(uint64(2), nil)
+		be.On("GetRevision", "aabbcc", "def", uint64(2), "").Return(doc, nil)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
 		assert.Equal(t, 200, w.Code)
-		assert.Equal(t, "foo", w.Body.String())
-		assert.Equal(t, "a1b2c3", w.Header().Get("Config-Encryption-KeyID"))
+		assert.Equal(t, `{"blah":"foo"}`+"\n", w.Body.String())
 	})
 
-	n.It("returns an encrypted value as json", func() {
-		req, err := http.NewRequest("GET", "/aabbcc/~def/bar", nil)
+	n.It("returns 404 for a missing revision", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah?rev=9", nil)
 		require.NoError(t, err)
 
-		req.Header.Set("Accept", "application/json")
+		be.On("GetRevision", "aabbcc", "def", uint64(9), "blah").Return("", ErrNoRevision)
 
-		encVal := EncryptedValue{
-			Value: []byte("foo"),
-			Keyid: "a1b2c3",
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 404, w.Code)
+	})
+
+	n.It("lists the revisions of a space", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/_history", nil)
+		require.NoError(t, err)
+
+		revs := []*Revision{
+			{Index: 1, Time: time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC), Writer: "3b6a47d1", Key: "blah"},
 		}
 
-		be.On("Get", "aabbcc", "def", "bar").Return(encVal, nil)
+		be.On("History", "aabbcc", "def").Return(revs, nil)
 
 		w := httptest.NewRecorder()
 
 		h.ServeHTTP(w, req)
 
-		json := fmt.Sprintf(`{"keyid":"%s","value":"%s"}%s`,
-			"a1b2c3", base64.StdEncoding.EncodeToString(encVal.Value), "\n")
+		expected := `[{"index":1,"time":"2015-01-02T15:04:05Z","writer":"3b6a47d1","key":"blah"}]` + "\n"
 
 		assert.Equal(t, 200, w.Code)
-		assert.Equal(t, json, w.Body.String())
+		assert.Equal(t, expected, w.Body.String())
 	})
 
-	n.Meow()
-}
+	n.It("can roll a space back to an old revision", func() {
+		req, err := http.NewRequest("POST", "/aabbcc/~def/_rollback?rev=2", nil)
+		require.NoError(t, err)
+
+		be.On("Rollback", "aabbcc", "aabbcc", "def", uint64(2)).Return(uint64(5), nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "5\n", w.Body.String())
+		assert.Equal(t, "5", w.Header().Get("Config-Index"))
+	})
+
+	n.It("can roll back a space with a header token", func() {
+		req, err := http.NewRequest("POST", "/~def/_rollback?rev=2", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Config-Token", "aabbcc")
+
+		be.On("Rollback", "aabbcc", "aabbcc", "def", uint64(2)).Return(uint64(5), nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("requires a revision to roll back to", func() {
+		req, err := http.NewRequest("POST", "/aabbcc/~def/_rollback", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("refuses to roll back through a view", func() {
+		req, err := http.NewRequest("POST", "/v-ddeeff/~def/_rollback?rev=2", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("refuses to list revisions through a view", func() {
+		req, err := http.NewRequest("GET", "/v-ddeeff/~def/_history", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("returns an ETag for a value", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "aabbcc", "def", "blah").Return("foo", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, ETag("foo"), w.Header().Get("ETag"))
+	})
+
+	n.It("sets a key conditionally with If-Match", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		req.Header.Set("If-Match", `"abcdef"`)
+
+		cond := &Precondition{IfMatch: `"abcdef"`}
+
+		be.On("SetIf", "aabbcc", "aabbcc", "def", "blah", "foo", cond).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("returns 412 when a precondition fails", func() {
+		req, err := http.NewRequest("DELETE", "/aabbcc/~def/blah", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("If-None-Match", "*")
+
+		cond := &Precondition{IfNoneMatch: "*"}
+
+		be.On("SetIf", "aabbcc", "aabbcc", "def", "blah", nil, cond).Return(ErrPreconditionFailed)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 412, w.Code)
+	})
+
+	n.It("maps view tokens to their parent on get", func() {
+		req, err := http.NewRequest("GET", "/v-ddeeff/~def/bar", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "_", "views", "v-ddeeff").Return("aabbcc", nil)
+
+		be.On("Get", "aabbcc", "def", "bar").Return("foo", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, "foo\n", w.Body.String())
+	})
+
+	n.It("refuses to set a key through a view token", func() {
+		req, err := http.NewRequest("PUT", "/v-ddeeff/~def/bar", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("refuses to delete a key through a view token", func() {
+		req, err := http.NewRequest("DELETE", "/v-ddeeff/~def/bar", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("can create a view of a token", func() {
+		req, err := http.NewRequest("POST", "/create/view/aabbcc", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		tg.On("NewToken").Return("ddeeff")
+
+		be.On("Set", "_", "views", "v-ddeeff", "aabbcc").Return(nil)
+		be.On("Set", "_", "viewlist", "aabbcc.v-ddeeff", true).Return(nil)
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "v-ddeeff\n", w.Body.String())
+	})
+
+	n.It("refuses to create a view of a view", func() {
+		req, err := http.NewRequest("POST", "/create/view/v-aabbcc", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("lists the views of a token", func() {
+		req, err := http.NewRequest("GET", "/_views/aabbcc", nil)
+		require.NoError(t, err)
+
+		views := map[string]interface{}{
+			"v-ddeeff": true,
+			"v-112233": true,
+		}
+
+		be.On("Get", "_", "viewlist", "aabbcc").Return(views, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "v-112233\nv-ddeeff\n", w.Body.String())
+	})
+
+	n.It("can revoke a view", func() {
+		req, err := http.NewRequest("DELETE", "/_views/aabbcc/v-ddeeff", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "_", "views", "v-ddeeff").Return("aabbcc", nil)
+		be.On("Set", "_", "views", "v-ddeeff", nil).Return(nil)
+		be.On("Set", "_", "viewlist", "aabbcc.v-ddeeff", nil).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("only revokes views of the given parent", func() {
+		req, err := http.NewRequest("DELETE", "/_views/112233/v-ddeeff", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "_", "views", "v-ddeeff").Return("aabbcc", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 404, w.Code)
+	})
+
+	n.It("refuses spaces that aren't valid names", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~../blah", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("refuses tokens that aren't valid names", func() {
+		req, err := http.NewRequest("GET", "/~def/blah", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Config-Token", "../aabbcc")
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("refuses derived tokens of invalid names", func() {
+		req, err := http.NewRequest("POST", "/create/view/..", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("refuses to use the reserved token", func() {
+		req, err := http.NewRequest("GET", "/_/~views/v-ddeeff", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("can create an access token with limited capabilities", func() {
+		req, err := http.NewRequest("POST", "/create/access/aabbcc?cap=read&space=def&prefix=db", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		tg.On("NewToken").Return("ddeeff")
+
+		caps := &Capabilities{
+			Read:     true,
+			Spaces:   []string{"def"},
+			Prefixes: []string{"db"},
+		}
+
+		be.On("Set", "_", "access", "a-ddeeff", accessEntry("aabbcc", caps)).Return(nil)
+		be.On("Set", "_", "accesslist", "aabbcc.a-ddeeff", true).Return(nil)
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "a-ddeeff\n", w.Body.String())
+	})
+
+	n.It("refuses unknown capabilities", func() {
+		req, err := http.NewRequest("POST", "/create/access/aabbcc?cap=root", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("requires admin rights to create derived tokens", func() {
+		req, err := http.NewRequest("POST", "/create/view/a-ddeeff", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"read":   true,
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("refuses access tokens exceeding the creating token", func() {
+		req, err := http.NewRequest("POST", "/create/access/a-ddeeff?cap=read&space=other", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"read":   true,
+			"admin":  true,
+			"spaces": []interface{}{"def"},
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("maps access tokens to their parent on get", func() {
+		req, err := http.NewRequest("GET", "/a-ddeeff/~def/db/host", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent":   "aabbcc",
+			"read":     true,
+			"prefixes": []interface{}{"db"},
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+		be.On("Get", "aabbcc", "def", "db.host").Return("foo", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "foo\n", w.Body.String())
+	})
+
+	n.It("refuses reads outside of an access token's prefixes", func() {
+		req, err := http.NewRequest("GET", "/a-ddeeff/~def/web", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent":   "aabbcc",
+			"read":     true,
+			"prefixes": []interface{}{"db"},
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("refuses writes through a read-only access token", func() {
+		req, err := http.NewRequest("PUT", "/a-ddeeff/~def/db", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"read":   true,
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("writes through an access token with write rights", func() {
+		req, err := http.NewRequest("DELETE", "/a-ddeeff/~def/db", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"write":  true,
+			"spaces": []interface{}{"def"},
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+		be.On("SetBy", "a-ddeeff", "aabbcc", "def", "db", nil).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("can revoke an access token", func() {
+		req, err := http.NewRequest("DELETE", "/_access/aabbcc/a-ddeeff", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"read":   true,
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+		be.On("Set", "_", "access", "a-ddeeff", nil).Return(nil)
+		be.On("Set", "_", "accesslist", "aabbcc.a-ddeeff", nil).Return(nil)
+		be.On("Get", "_", "minted", "a-ddeeff").Return(map[string]interface{}(nil), nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("deletes one-time tokens on first get", func() {
+		req, err := http.NewRequest("GET", "/o-ddeeff/~def/bar", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "_", "onetime", "o-ddeeff").Return("aabbcc", nil)
+		be.On("Set", "_", "onetime", "o-ddeeff", nil).Return(nil)
+
+		be.On("Get", "aabbcc", "def", "bar").Return("foo", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, "foo\n", w.Body.String())
+	})
+
+	n.It("deletes one-time tokens on first set", func() {
+		req, err := http.NewRequest("PUT", "/o-ddeeff/~def/bar", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		be.On("Get", "_", "onetime", "o-ddeeff").Return("aabbcc", nil)
+		be.On("Set", "_", "onetime", "o-ddeeff", nil).Return(nil)
+
+		be.On("SetBy", "o-ddeeff", "aabbcc", "def", "bar", "foo").Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("keeps one-time tokens when the set fails", func() {
+		req, err := http.NewRequest("PUT", "/o-ddeeff/~def/bar", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		be.On("Get", "_", "onetime", "o-ddeeff").Return("aabbcc", nil)
+
+		be.On("SetBy", "o-ddeeff", "aabbcc", "def", "bar", "foo").Return(errors.New("disk full"))
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 500, w.Code)
+
+		be.AssertNotCalled(t, "Set", "_", "onetime", "o-ddeeff", nil)
+	})
+
+	n.It("keeps one-time tokens when the request is bad", func() {
+		req, err := http.NewRequest("PUT", "/o-ddeeff/~def/bar", strings.NewReader("{"))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/json")
+
+		be.On("Get", "_", "onetime", "o-ddeeff").Return("aabbcc", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+
+		be.AssertNotCalled(t, "Set", "_", "onetime", "o-ddeeff", nil)
+	})
+
+	n.It("records an encrypted value along with the keyid", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/bar", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		req.Header.Set("Config-Encryption-KeyID", "a1b2c3")
+
+		encVal := &EncryptedValue{
+			Value: []byte("foo"),
+			Keyid: "a1b2c3",
+		}
+
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "bar", encVal).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("returns an encrypted value along with the keyid", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/bar", nil)
+		require.NoError(t, err)
+
+		encVal := EncryptedValue{
+			Value: []byte("foo"),
+			Keyid: "a1b2c3",
+		}
+
+		be.On("Get", "aabbcc", "def", "bar").Return(encVal, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "foo", w.Body.String())
+		assert.Equal(t, "a1b2c3", w.Header().Get("Config-Encryption-KeyID"))
+	})
+
+	n.It("returns an encrypted value as json", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/bar", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Accept", "application/json")
+
+		encVal := EncryptedValue{
+			Value: []byte("foo"),
+			Keyid: "a1b2c3",
+		}
+
+		be.On("Get", "aabbcc", "def", "bar").Return(encVal, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		json := fmt.Sprintf(`{"keyid":"%s","value":"%s"}%s`,
+			"a1b2c3", base64.StdEncoding.EncodeToString(encVal.Value), "\n")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, json, w.Body.String())
+	})
+
+	n.It("lists the spaces of a token", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/_spaces", nil)
+		require.NoError(t, err)
+
+		be.On("List", "aabbcc").Return([]string{"db", "default"}, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "db\ndefault\n", w.Body.String())
+	})
+
+	n.It("lists the spaces of a header token as json", func() {
+		req, err := http.NewRequest("GET", "/_spaces.json", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Config-Token", "aabbcc")
+
+		be.On("List", "aabbcc").Return([]string{"db", "default"}, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, `["db","default"]`+"\n", w.Body.String())
+	})
+
+	n.It("only lists the spaces an access token may read", func() {
+		req, err := http.NewRequest("GET", "/a-ddeeff/_spaces", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"read":   true,
+			"spaces": []interface{}{"db"},
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+		be.On("List", "aabbcc").Return([]string{"db", "default"}, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "db\n", w.Body.String())
+	})
+
+	n.It("lists the keys of a space", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/?keys", nil)
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"name": "web",
+			"db": map[string]interface{}{
+				"host": "localhost",
+				"port": 5432,
+			},
+		}
+
+		be.On("Get", "aabbcc", "def", "").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "db.host\ndb.port\nname\n", w.Body.String())
+	})
+
+	n.It("lists the keys under a key", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/db?keys", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Accept", "application/json")
+
+		doc := map[string]interface{}{
+			"host": "localhost",
+			"port": 5432,
+		}
+
+		be.On("Get", "aabbcc", "def", "db").Return(doc, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, `["db.host","db.port"]`+"\n", w.Body.String())
+	})
+
+	n.It("can delete a whole space", func() {
+		req, err := http.NewRequest("DELETE", "/aabbcc/~def", nil)
+		require.NoError(t, err)
+
+		be.On("DeleteSpace", "aabbcc", "def", (*Precondition)(nil)).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("refuses to delete a space outside an access token's prefixes", func() {
+		req, err := http.NewRequest("DELETE", "/a-ddeeff/~def", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent":   "aabbcc",
+			"write":    true,
+			"prefixes": []interface{}{"db"},
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("deletes a token and the tokens derived from it", func() {
+		req, err := http.NewRequest("DELETE", "/_tokens/aabbcc", nil)
+		require.NoError(t, err)
+
+		views := map[string]interface{}{"v-ddeeff": true}
+		onetime := map[string]interface{}{
+			"o-gghhii": "aabbcc",
+			"o-jjkkll": "mmnnoo",
+		}
+
+		be.On("Get", "_", "viewlist", "aabbcc").Return(views, nil)
+		be.On("Set", "_", "views", "v-ddeeff", nil).Return(nil)
+		be.On("Set", "_", "viewlist", "aabbcc", nil).Return(nil)
+		be.On("Get", "_", "accesslist", "aabbcc").Return(map[string]interface{}(nil), nil)
+		be.On("Set", "_", "accesslist", "aabbcc", nil).Return(nil)
+		be.On("Get", "_", "onetime", "").Return(onetime, nil)
+		be.On("Set", "_", "onetime", "o-gghhii", nil).Return(nil)
+		be.On("List", "aabbcc").Return([]string{"default"}, nil)
+		be.On("DeleteToken", "aabbcc").Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("refuses to delete a token through an access token", func() {
+		req, err := http.NewRequest("DELETE", "/_tokens/a-ddeeff", nil)
+		require.NoError(t, err)
+
+		entry := map[string]interface{}{
+			"parent": "aabbcc",
+			"read":   true,
+			"write":  true,
+			"admin":  true,
+		}
+
+		be.On("Get", "_", "access", "a-ddeeff").Return(entry, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("refuses to delete a token through a view", func() {
+		req, err := http.NewRequest("DELETE", "/_tokens/v-ddeeff", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.It("replaces a space with a json document", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def", strings.NewReader(`{"name": "vektra", "sub": {"blah": "foo"}}`))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "foo"},
+		}
+
+		be.On("Update", "aabbcc", "aabbcc", "def", doc, false, (*Precondition)(nil)).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("merges a toml document into a space given by extension", func() {
+		body := "name = \"vektra\"\n\n[sub]\nblah = \"foo\"\n"
+
+		req, err := http.NewRequest("PUT", "/aabbcc/~def.toml?merge=true", strings.NewReader(body))
+		require.NoError(t, err)
+
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "foo"},
+		}
+
+		be.On("Update", "aabbcc", "aabbcc", "def", doc, true, (*Precondition)(nil)).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("replaces the default space with a yaml document", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/", strings.NewReader("name: vektra\nsub:\n  blah: foo\n"))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/x-yaml")
+		req.Header.Set("If-Match", `"abcdef"`)
+
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "foo"},
+		}
+
+		cond := &Precondition{IfMatch: `"abcdef"`}
+
+		be.On("Update", "aabbcc", "aabbcc", "default", doc, false, cond).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("refuses documents of an unknown format", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def", strings.NewReader("<name>vektra</name>"))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/xml")
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 415, w.Code)
+	})
+
+	n.It("refuses documents that aren't a map", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def.json", strings.NewReader(`["vektra"]`))
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+	})
+
+	n.It("merge patches a space", func() {
+		req, err := http.NewRequest("PATCH", "/aabbcc/~def", strings.NewReader(`{"name": null, "sub": {"blah": "foo"}}`))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+
+		doc := map[string]interface{}{
+			"name": nil,
+			"sub":  map[string]interface{}{"blah": "foo"},
+		}
+
+		be.On("Update", "aabbcc", "aabbcc", "def", doc, true, (*Precondition)(nil)).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("json patches a space with a header token", func() {
+		req, err := http.NewRequest("PATCH", "/~def", strings.NewReader(`[{"op": "remove", "path": "/name"}]`))
+		require.NoError(t, err)
+
+		req.Header.Set("Config-Token", "aabbcc")
+		req.Header.Set("Content-Type", "application/json-patch+json")
+
+		ops := []PatchOp{{Op: "remove", Path: "/name"}}
+
+		be.On("Patch", "aabbcc", "aabbcc", "def", ops, (*Precondition)(nil)).Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("returns 409 when a patch doesn't apply", func() {
+		req, err := http.NewRequest("PATCH", "/aabbcc/~def", strings.NewReader(`[{"op": "remove", "path": "/name"}]`))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/json-patch+json")
+
+		ops := []PatchOp{{Op: "remove", Path: "/name"}}
+
+		be.On("Patch", "aabbcc", "aabbcc", "def", ops, (*Precondition)(nil)).Return(&PatchError{"remove /name: name not found"})
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 409, w.Code)
+	})
+
+	n.It("refuses patches of an unknown type", func() {
+		req, err := http.NewRequest("PATCH", "/aabbcc/~def", strings.NewReader(`{}`))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 415, w.Code)
+	})
+
+	n.It("picks the format of a response by Accept q-values", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Accept", "application/json;q=0.5, text/x-toml, */*;q=0.1")
+
+		be.On("Get", "aabbcc", "def", "").Return(map[string]interface{}{"bar": "foo"}, nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/toml", w.Header().Get("Content-Type"))
+		assert.Equal(t, "bar = \"foo\"\n", w.Body.String())
+	})
+
+	n.It("returns 406 when no format is acceptable for a space", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Accept", "application/xml, application/json;q=0")
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 406, w.Code)
+	})
+
+	n.It("returns 406 for a space with an unknown extension", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def.xml", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 406, w.Code)
+	})
+
+	n.It("returns a key as text when no format is acceptable", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/blah", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Accept", "text/html")
+
+		be.On("Get", "aabbcc", "def", "blah").Return("foo", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "foo\n", w.Body.String())
+	})
+
+	n.It("keeps a dotted last segment that isn't a format in the key", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/db/host.name", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "aabbcc", "def", "db.host.name").Return("localhost", nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "localhost\n", w.Body.String())
+	})
+
+	n.It("reads a key as json given the extension", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah.json", strings.NewReader(`"foo"`))
+		require.NoError(t, err)
+
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", "foo").Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("stores a key of an unknown Content-Type as text", func() {
+		for _, contentType := range []string{"application/x-www-form-urlencoded", "application/octet-stream"} {
+			req, err := http.NewRequest("PUT", "/aabbcc/~def/blah", strings.NewReader("foo=bar"))
+			require.NoError(t, err)
+
+			req.Header.Set("Content-Type", contentType)
+
+			be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", "foo=bar").Return(nil).Once()
+
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, 200, w.Code, contentType)
+		}
+	})
+
+	n.It("stores a key with a dotted last segment that isn't a format as text", func() {
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/nginx.conf", strings.NewReader("server {}"))
+		require.NoError(t, err)
+
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "nginx.conf", "server {}").Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.It("uses codecs registered by embedders", func() {
+		h.RegisterCodec(&Codec{
+			Name:       "upper",
+			MediaTypes: []string{"text/x-upper"},
+			Extensions: []string{".upper"},
+			Encoder: EncoderFunc(func(w io.Writer, key string, val interface{}, params url.Values) error {
+				_, err := fmt.Fprintln(w, strings.ToUpper(fmt.Sprint(val)))
+				return err
+			}),
+			Decoder: DecoderFunc(func(r io.Reader) (interface{}, error) {
+				data, err := ioutil.ReadAll(r)
+				return strings.ToLower(string(data)), err
+			}),
+		})
+
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah", strings.NewReader("FOO"))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "text/x-upper")
+
+		be.On("SetBy", "aabbcc", "aabbcc", "def", "blah", "foo").Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		req, err = http.NewRequest("GET", "/aabbcc/~def/blah.upper", nil)
+		require.NoError(t, err)
+
+		be.On("Get", "aabbcc", "def", "blah").Return("foo", nil)
+
+		w = httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "FOO\n", w.Body.String())
+	})
+
+	n.It("returns 501 for what a plain backend can't do", func() {
+		h = NewHTTPApi(&tg, plainBackend{&be})
+
+		reqs := []struct{ method, path, contentType, ifMatch, body string }{
+			{"GET", "/aabbcc/~def/_history", "", "", ""},
+			{"GET", "/aabbcc/~def/blah?rev=1", "", "", ""},
+			{"GET", "/aabbcc/~def/blah?wait=1s", "", "", ""},
+			{"POST", "/aabbcc/~def/_rollback?rev=1", "", "", ""},
+			{"PUT", "/aabbcc/~def.json", "", "", "{}"},
+			{"PATCH", "/aabbcc/~def", "application/merge-patch+json", "", "{}"},
+			{"PATCH", "/aabbcc/~def", "application/json-patch+json", "", "[]"},
+			{"PUT", "/aabbcc/~def/blah", "", "*", "foo"},
+			{"DELETE", "/aabbcc/~def", "", "", ""},
+			{"GET", "/aabbcc/~def/_spaces", "", "", ""},
+			{"DELETE", "/_tokens/aabbcc", "", "", ""},
+		}
+
+		for _, r := range reqs {
+			req, err := http.NewRequest(r.method, r.path, strings.NewReader(r.body))
+			require.NoError(t, err)
+
+			if r.contentType != "" {
+				req.Header.Set("Content-Type", r.contentType)
+			}
+
+			if r.ifMatch != "" {
+				req.Header.Set("If-Match", r.ifMatch)
+			}
+
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, 501, w.Code, r.method+" "+r.path)
+		}
+	})
+
+	n.It("writes with Set to a backend that doesn't record writers", func() {
+		h = NewHTTPApi(&tg, plainBackend{&be})
+
+		req, err := http.NewRequest("PUT", "/aabbcc/~def/blah", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		be.On("Set", "aabbcc", "def", "blah", "foo").Return(nil)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
+
+	n.Meow()
+}
+
+// plainBackend hides every optional interface of the Backend it wraps.
+type plainBackend struct {
+	Backend
+}
+
+// publishingBackend makes the MockBackend it wraps a Publisher. Tests
+// publish to the hub themselves.
+type publishingBackend struct {
+	*MockBackend
+}
+
+func (publishingBackend) Subscribe(fn func(*Change)) {}
@@ -0,0 +1,125 @@
+package datum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// renderINI writes doc as an INI file. Each map at the top level becomes
+// a section, with anything nested deeper flattened into dotted keys. The
+// other top level values come first, outside of any section.
+func renderINI(w io.Writer, doc map[string]interface{}) {
+	var (
+		globals  = make(map[string]string)
+		sections []string
+	)
+
+	for k, v := range doc {
+		if _, ok := v.(map[string]interface{}); ok {
+			sections = append(sections, k)
+		} else {
+			flattenPaths(globals, k, v)
+		}
+	}
+
+	sort.Strings(sections)
+
+	for _, k := range sortedKeys(globals) {
+		fmt.Fprintf(w, "%s = %s\n", k, iniValue(globals[k]))
+	}
+
+	for i, section := range sections {
+		if i > 0 || len(globals) > 0 {
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprintf(w, "[%s]\n", section)
+
+		flat := make(map[string]string)
+
+		flattenPaths(flat, "", doc[section])
+
+		for _, k := range sortedKeys(flat) {
+			fmt.Fprintf(w, "%s = %s\n", k, iniValue(flat[k]))
+		}
+	}
+}
+
+// iniValue quotes s if it would otherwise be read back differently or
+// taken for a comment.
+func iniValue(s string) string {
+	if s != strings.TrimSpace(s) || strings.ContainsAny(s, "\";#") || strconv.Quote(s) != `"`+s+`"` {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// parseINI reads an INI file into a document, with sections as maps at
+// the top level and dotted keys nested within them. Every value is a
+// string.
+func parseINI(r io.Reader) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+
+	scanner := bufio.NewScanner(r)
+
+	var (
+		section string
+		lineno  int
+	)
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' || len(line) == 2 {
+				return nil, fmt.Errorf("line %d: invalid section", lineno)
+			}
+
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		val := strings.TrimSpace(line[eq+1:])
+
+		if strings.HasPrefix(val, `"`) {
+			var err error
+
+			val, err = strconv.Unquote(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value", lineno)
+			}
+		}
+
+		if section != "" {
+			key = section + "." + key
+		}
+
+		err := setPath(doc, key, val)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
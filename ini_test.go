@@ -0,0 +1,75 @@
+package datum
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestINI(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("renders the top level as sections", func() {
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"db": map[string]interface{}{
+				"host": "localhost",
+				"pool": map[string]interface{}{"size": int64(5)},
+			},
+			"web": map[string]interface{}{
+				"motd": " hi; there",
+			},
+		}
+
+		var buf bytes.Buffer
+
+		renderINI(&buf, doc)
+
+		expected := "name = vektra\n\n[db]\nhost = localhost\npool.size = 5\n\n[web]\nmotd = \" hi; there\"\n"
+
+		assert.Equal(t, expected, buf.String())
+	})
+
+	n.It("parses what it renders", func() {
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"db": map[string]interface{}{
+				"host": "line\nbreak",
+				"pool": map[string]interface{}{"size": "5"},
+			},
+		}
+
+		var buf bytes.Buffer
+
+		renderINI(&buf, doc)
+
+		parsed, err := parseINI(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, doc, parsed)
+	})
+
+	n.It("skips comments", func() {
+		doc, err := parseINI(strings.NewReader("; comment\n# also\n[db]\nhost=localhost\n"))
+		require.NoError(t, err)
+
+		expected := map[string]interface{}{
+			"db": map[string]interface{}{"host": "localhost"},
+		}
+
+		assert.Equal(t, expected, doc)
+	})
+
+	n.It("reports the line of an error", func() {
+		_, err := parseINI(strings.NewReader("[db]\nhost\n"))
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "line 2")
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,106 @@
+package datum
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Lister is implemented by Backends that can list the spaces of a token.
+// HTTPApi needs it for _spaces.
+type Lister interface {
+	List(token string) ([]string, error)
+}
+
+// spaces lists the spaces of a token, or the ones it's limited to.
+func (h *HTTPApi) spaces(w http.ResponseWriter, token string, codec *Codec) {
+	lister, ok := h.be.(Lister)
+	if !ok {
+		notImplemented(w, "listing spaces")
+		return
+	}
+
+	if !checkNames(w, token) {
+		return
+	}
+
+	reader := token
+
+	token, caps, ok := h.resolve(w, token, CapRead)
+	if !ok {
+		return
+	}
+
+	if !caps.Read {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	spaces, err := lister.List(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.consume(reader)
+
+	var visible []string
+
+	for _, space := range spaces {
+		if len(caps.Spaces) == 0 || contains(caps.Spaces, space) {
+			visible = append(visible, space)
+		}
+	}
+
+	renderList(w, visible, codec)
+}
+
+// keyPaths returns the dotted paths of every value within val, which is
+// at key, sorted.
+func keyPaths(key string, val interface{}) []string {
+	paths := appendKeyPaths(nil, key, val)
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func appendKeyPaths(paths []string, key string, val interface{}) []string {
+	doc, ok := val.(map[string]interface{})
+	if !ok {
+		if val == nil || key == "" {
+			return paths
+		}
+
+		return append(paths, key)
+	}
+
+	for k, v := range doc {
+		if key != "" {
+			k = key + "." + k
+		}
+
+		paths = appendKeyPaths(paths, k, v)
+	}
+
+	return paths
+}
+
+// renderList writes list with codec, or one entry per line for the
+// default text codec.
+func renderList(w http.ResponseWriter, list []string, codec *Codec) {
+	if codec.Name != textCodec.Name {
+		vals := make([]interface{}, len(list))
+
+		for i, s := range list {
+			vals[i] = s
+		}
+
+		writeEncoded(w, codec, "", vals, nil)
+		return
+	}
+
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\n", s)
+	}
+}
@@ -0,0 +1,225 @@
+package datum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// MemoryStore keeps blobs in memory. It's meant for tests and for
+// deployments whose config doesn't need to outlive the process. If it has
+// a Path, it's loaded from a snapshot there and saved back on Close.
+type MemoryStore struct {
+	Path string
+
+	lock  sync.RWMutex
+	blobs map[string]map[string][]byte
+}
+
+// memoryBlob is how a blob is kept in a MemoryStore snapshot.
+type memoryBlob struct {
+	Token string `codec:"token"`
+	Space string `codec:"space"`
+	Blob  []byte `codec:"blob"`
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blobs: make(map[string]map[string][]byte)}
+}
+
+// OpenMemoryStore returns a MemoryStore that snapshots to path, loading
+// the snapshot already there if there is one.
+func OpenMemoryStore(path string) (*MemoryStore, error) {
+	m := NewMemoryStore()
+	m.Path = path
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+
+		return nil, err
+	}
+
+	err = m.load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Snapshot writes every blob to path, replacing it atomically.
+func (m *MemoryStore) Snapshot(path string) error {
+	data, err := m.dump()
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(filepath.Dir(path), path, data)
+}
+
+// dump encodes every blob as a snapshot.
+func (m *MemoryStore) dump() ([]byte, error) {
+	var snapshot []memoryBlob
+
+	m.lock.RLock()
+
+	for token, spaces := range m.blobs {
+		for space, blob := range spaces {
+			snapshot = append(snapshot, memoryBlob{token, space, blob})
+		}
+	}
+
+	m.lock.RUnlock()
+
+	var data []byte
+
+	err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// load replaces every blob with those in a snapshot made by dump.
+func (m *MemoryStore) load(data []byte) error {
+	var snapshot []memoryBlob
+
+	err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.blobs = make(map[string]map[string][]byte)
+
+	for _, b := range snapshot {
+		m.set(b.Token, b.Space, b.Blob)
+	}
+
+	return nil
+}
+
+// Close saves a snapshot to Path, if set.
+func (m *MemoryStore) Close() error {
+	if m.Path == "" {
+		return nil
+	}
+
+	return m.Snapshot(m.Path)
+}
+
+func (m *MemoryStore) Set(token, space string, val []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.set(token, space, val)
+
+	return nil
+}
+
+func (m *MemoryStore) set(token, space string, val []byte) {
+	spaces, ok := m.blobs[token]
+	if !ok {
+		spaces = make(map[string][]byte)
+		m.blobs[token] = spaces
+	}
+
+	// Copy val so the caller can't change it behind our back.
+	spaces[space] = append([]byte{}, val...)
+}
+
+func (m *MemoryStore) Get(token, space string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	data, ok := m.blobs[token][space]
+	if !ok {
+		return nil, nil
+	}
+
+	return append([]byte{}, data...), nil
+}
+
+func (m *MemoryStore) List(token string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var spaces []string
+
+	for space := range m.blobs[token] {
+		spaces = append(spaces, space)
+	}
+
+	return spaces, nil
+}
+
+func (m *MemoryStore) Delete(token, space string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.blobs[token], space)
+
+	if len(m.blobs[token]) == 0 {
+		delete(m.blobs, token)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) CompareAndSet(token, space string, old, val []byte) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cur, ok := m.blobs[token][space]
+
+	if ok != (old != nil) || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+
+	m.set(token, space, val)
+
+	return true, nil
+}
+
+// SetBatch sets the blobs of several spaces of token at once.
+func (m *MemoryStore) SetBatch(token string, blobs map[string][]byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for space, val := range blobs {
+		m.set(token, space, val)
+	}
+
+	return nil
+}
+
+// CompareAndSetBatch sets the blobs of several spaces of token at once,
+// if those in old are unchanged.
+func (m *MemoryStore) CompareAndSetBatch(token string, old map[string][]byte, blobs map[string][]byte) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for space, blob := range old {
+		cur, ok := m.blobs[token][space]
+
+		if ok != (blob != nil) || !bytes.Equal(cur, blob) {
+			return false, nil
+		}
+	}
+
+	for space, val := range blobs {
+		m.set(token, space, val)
+	}
+
+	return true, nil
+}
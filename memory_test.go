@@ -0,0 +1,130 @@
+package datum
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestMemoryStore(t *testing.T) {
+	n := neko.Start(t)
+
+	var store *MemoryStore
+
+	n.Setup(func() {
+		store = NewMemoryStore()
+	})
+
+	testBlobStore(t, n, func() BlobStore {
+		return store
+	})
+
+	n.It("doesn't share blobs with callers", func() {
+		val := []byte("foo")
+
+		err := store.Set("aabbcc", "default", val)
+		require.NoError(t, err)
+
+		val[0] = 'g'
+
+		data, err := store.Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+	})
+
+	n.It("saves a snapshot on close and loads it on open", func() {
+		tmpdir, err := ioutil.TempDir("", "memory")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(tmpdir)
+
+		path := filepath.Join(tmpdir, "snapshot")
+
+		store, err := OpenMemoryStore(path)
+		require.NoError(t, err)
+
+		err = store.Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		err = store.Close()
+		require.NoError(t, err)
+
+		store, err = OpenMemoryStore(path)
+		require.NoError(t, err)
+
+		data, err := store.Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+	})
+
+	n.It("serves a full HTTPApi", func() {
+		h := NewHTTPApi(UUIDTokenGen(), NewMsgpackBackend(store))
+
+		req, err := http.NewRequest("POST", "/create", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code)
+
+		token := strings.TrimSpace(w.Body.String())
+
+		req, err = http.NewRequest("PUT", "/"+token+"/~def/blah", strings.NewReader("foo"))
+		require.NoError(t, err)
+
+		w = httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code)
+
+		req, err = http.NewRequest("GET", "/"+token+"/~def/blah", nil)
+		require.NoError(t, err)
+
+		w = httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "foo\n", w.Body.String())
+	})
+
+	n.It("round trips a yaml document through the store", func() {
+		h := NewHTTPApi(UUIDTokenGen(), NewMsgpackBackend(store))
+
+		doc := "name: vektra\nports:\n- 80\n- 443\ntls:\n  enabled: true\n  ratio: 0.5\n"
+
+		req, err := http.NewRequest("PUT", "/aabbcc/~def.yaml", strings.NewReader(doc))
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code)
+
+		req, err = http.NewRequest("GET", "/aabbcc/~def.yaml", nil)
+		require.NoError(t, err)
+
+		w = httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, doc, w.Body.String())
+	})
+
+	n.Meow()
+}
@@ -1,6 +1,10 @@
 package datum
 
-import "github.com/stretchr/testify/mock"
+import (
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
 
 type MockBackend struct {
 	mock.Mock
@@ -20,6 +24,34 @@ func (m *MockBackend) Set(token string, space string, key string, val interface{
 
 	return r0
 }
+func (m *MockBackend) SetBy(writer string, token string, space string, key string, val interface{}) error {
+	ret := m.Called(writer, token, space, key, val)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+func (m *MockBackend) SetIf(writer string, token string, space string, key string, val interface{}, cond *Precondition) error {
+	ret := m.Called(writer, token, space, key, val, cond)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+func (m *MockBackend) Update(writer string, token string, space string, doc map[string]interface{}, merge bool, cond *Precondition) error {
+	ret := m.Called(writer, token, space, doc, merge, cond)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+func (m *MockBackend) Patch(writer string, token string, space string, ops []PatchOp, cond *Precondition) error {
+	ret := m.Called(writer, token, space, ops, cond)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
 func (m *MockBackend) Get(token string, space string, key string) (interface{}, error) {
 	ret := m.Called(token, space, key)
 
@@ -28,3 +60,65 @@ func (m *MockBackend) Get(token string, space string, key string) (interface{},
 
 	return r0, r1
 }
+func (m *MockBackend) Index(token string, space string) (uint64, error) {
+	ret := m.Called(token, space)
+
+	r0 := ret.Get(0).(uint64)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
+func (m *MockBackend) List(token string) ([]string, error) {
+	ret := m.Called(token)
+
+	r0 := ret.Get(0).([]string)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
+func (m *MockBackend) DeleteSpace(token string, space string, cond *Precondition) error {
+	ret := m.Called(token, space, cond)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+func (m *MockBackend) DeleteToken(token string) error {
+	ret := m.Called(token)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+func (m *MockBackend) History(token string, space string) ([]*Revision, error) {
+	ret := m.Called(token, space)
+
+	r0 := ret.Get(0).([]*Revision)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
+func (m *MockBackend) GetRevision(token string, space string, idx uint64, key string) (interface{}, error) {
+	ret := m.Called(token, space, idx, key)
+
+	r0 := ret.Get(0).(interface{})
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
+func (m *MockBackend) RevisionAt(token string, space string, t time.Time) (uint64, error) {
+	ret := m.Called(token, space, t)
+
+	r0 := ret.Get(0).(uint64)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
+func (m *MockBackend) Rollback(writer string, token string, space string, idx uint64) (uint64, error) {
+	ret := m.Called(writer, token, space, idx)
+
+	r0 := ret.Get(0).(uint64)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
@@ -21,3 +21,26 @@ func (m *MockBlobStore) Get(key string, space string) ([]byte, error) {
 
 	return r0, r1
 }
+func (m *MockBlobStore) List(key string) ([]string, error) {
+	ret := m.Called(key)
+
+	r0 := ret.Get(0).([]string)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
+func (m *MockBlobStore) Delete(key string, space string) error {
+	ret := m.Called(key, space)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+func (m *MockBlobStore) CompareAndSet(key string, space string, old []byte, val []byte) (bool, error) {
+	ret := m.Called(key, space, old, val)
+
+	r0 := ret.Get(0).(bool)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
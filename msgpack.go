@@ -5,7 +5,10 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ugorji/go/codec"
 )
@@ -13,14 +16,54 @@ import (
 type BlobStore interface {
 	Set(key string, space string, val []byte) error
 	Get(key string, space string) ([]byte, error)
+
+	// CompareAndSet sets val only if the current blob is old, with nil
+	// meaning there is none. It reports whether val was set.
+	CompareAndSet(key string, space string, old []byte, val []byte) (bool, error)
+
+	// List returns the spaces of a token, in no particular order.
+	List(key string) ([]string, error)
+
+	// Delete removes a blob. Removing one that doesn't exist is not an
+	// error.
+	Delete(key string, space string) error
+}
+
+// BatchStore is implemented by BlobStores that can set several spaces of
+// a token in one transaction. MsgpackBackend uses it to keep a document,
+// its index, revisions and history consistent with each other.
+type BatchStore interface {
+	SetBatch(token string, blobs map[string][]byte) error
+
+	// CompareAndSetBatch sets blobs only if every space in old still
+	// holds the blob given for it, with nil meaning there is none. It
+	// reports whether blobs were set.
+	CompareAndSetBatch(token string, old map[string][]byte, blobs map[string][]byte) (bool, error)
 }
 
 type MsgpackBackend struct {
 	store BlobStore
+
+	// MaxRevisions is how many revisions of each space are kept, with
+	// the oldest dropped first. 0 keeps all of them.
+	MaxRevisions int
+
+	docLock sync.Mutex
+	docs    map[string]*docLock
+
+	subLock     sync.Mutex
+	subscribers []func(*Change)
+}
+
+// docLock serializes the writes to one document. refs counts the writers
+// holding or waiting on it, so it can be dropped once they're done.
+type docLock struct {
+	sync.Mutex
+	refs int
 }
 
 func NewMsgpackBackend(store BlobStore) *MsgpackBackend {
-	return &MsgpackBackend{store}
+	return &MsgpackBackend{store: store, MaxRevisions: DefaultMaxRevisions}
 }
 
 var msgpackHandle = &codec.MsgpackHandle{}
@@ -70,6 +113,43 @@ func (_ *encryptedValExt) ConvertExt(v reflect.Value) interface{} {
 
 func (_ *encryptedValExt) UpdateExt(v reflect.Value, i interface{}) {}
 
+// lock serializes writes to a space, including to the blobs that hold
+// its index and history. It returns the func to unlock it.
+func (m *MsgpackBackend) lock(token, space string) func() {
+	k := token + "/" + space
+
+	m.docLock.Lock()
+
+	if m.docs == nil {
+		m.docs = make(map[string]*docLock)
+	}
+
+	l, ok := m.docs[k]
+	if !ok {
+		l = &docLock{}
+		m.docs[k] = l
+	}
+
+	l.refs++
+
+	m.docLock.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		m.docLock.Lock()
+		defer m.docLock.Unlock()
+
+		l.refs--
+
+		if l.refs == 0 {
+			delete(m.docs, k)
+		}
+	}
+}
+
 func (m *MsgpackBackend) findSub(
 	doc map[string]interface{},
 	keys []string,
@@ -113,54 +193,355 @@ func (m *MsgpackBackend) prune(pos map[string]interface{}) {
 }
 
 func (m *MsgpackBackend) Set(token, space, key string, val interface{}) error {
-	blob, err := m.store.Get(token, space)
-	if err != nil {
-		return err
-	}
+	return m.SetBy(token, token, space, key, val)
+}
 
-	var doc map[string]interface{}
+// SetBy is Set, recording writer in the space's history as the token
+// that made the change.
+func (m *MsgpackBackend) SetBy(writer, token, space, key string, val interface{}) error {
+	return m.set(time.Now(), writer, token, space, key, val, nil)
+}
+
+// SetIf is SetBy, but only makes the change if cond is met by the current
+// value of key. If it isn't, ErrPreconditionFailed is returned.
+func (m *MsgpackBackend) SetIf(writer, token, space, key string, val interface{}, cond *Precondition) error {
+	return m.set(time.Now(), writer, token, space, key, val, cond)
+}
+
+// set is SetIf, recording the change as made at the time at.
+func (m *MsgpackBackend) set(at time.Time, writer, token, space, key string, val interface{}, cond *Precondition) error {
+	return m.write(at, writer, token, space, key, func(doc map[string]interface{}) (map[string]interface{}, interface{}, error) {
+		if cond != nil && key == "" {
+			var cur interface{}
+
+			if doc != nil {
+				cur = doc
+			}
+
+			if !cond.Met(cur) {
+				return nil, nil, ErrPreconditionFailed
+			}
+		}
+
+		if doc == nil {
+			doc = make(map[string]interface{})
+		}
+
+		parts := strings.Split(key, ".")
+
+		name := parts[len(parts)-1]
+
+		var pos map[string]interface{}
 
-	if blob != nil {
-		err = codec.NewDecoderBytes(blob, msgpackHandle).Decode(&doc)
+		if len(parts) == 1 {
+			pos = doc
+		} else {
+			var err error
+
+			pos, err = m.findSub(doc, parts[:len(parts)-1])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if cond != nil && key != "" && !cond.Met(pos[name]) {
+			return nil, nil, ErrPreconditionFailed
+		}
+
+		if val == nil {
+			delete(pos, name)
+			m.prune(doc)
+		} else {
+			pos[name] = val
+		}
+
+		return doc, val, nil
+	})
+}
+
+// Update replaces the document of space with doc in a single write, or
+// deep merges doc into it if merge is set. Merging follows JSON Merge
+// Patch: maps are merged key by key and nil values remove keys. If cond
+// is given, the current document must meet it.
+func (m *MsgpackBackend) Update(writer, token, space string, doc map[string]interface{}, merge bool, cond *Precondition) error {
+	return m.update(time.Now(), writer, token, space, doc, merge, cond)
+}
+
+// update is Update, recording the change as made at the time at.
+func (m *MsgpackBackend) update(at time.Time, writer, token, space string, doc map[string]interface{}, merge bool, cond *Precondition) error {
+	return m.write(at, writer, token, space, "", func(cur map[string]interface{}) (map[string]interface{}, interface{}, error) {
+		if cond != nil {
+			var val interface{}
+
+			if cur != nil {
+				val = cur
+			}
+
+			if !cond.Met(val) {
+				return nil, nil, ErrPreconditionFailed
+			}
+		}
+
+		if !merge || cur == nil {
+			cur = make(map[string]interface{})
+		}
+
+		mergeDocument(cur, doc)
+		m.prune(cur)
+
+		return cur, cur, nil
+	})
+}
+
+// write reads the document of space, passes it to change, which is given
+// nil if there is none, and stores the document change returns. The value
+// change returns is published as the new value of key. All of it happens
+// under the space's lock, and the document is only stored if it hasn't
+// changed since it was read, such as by another process sharing the
+// store; if it has, change is run again. The change is recorded as made
+// at the time at.
+func (m *MsgpackBackend) write(
+	at time.Time,
+	writer, token, space, key string,
+	change func(doc map[string]interface{}) (map[string]interface{}, interface{}, error),
+) error {
+	defer m.lock(token, space)()
+
+	for {
+		blob, err := m.store.Get(token, space)
+		if err != nil {
+			return err
+		}
+
+		var doc map[string]interface{}
+
+		if blob != nil {
+			err = codec.NewDecoderBytes(blob, msgpackHandle).Decode(&doc)
+			if err != nil {
+				return err
+			}
+		}
+
+		doc, val, err := change(doc)
 		if err != nil {
 			return err
 		}
+
+		var data []byte
+
+		err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(doc)
+		if err != nil {
+			return err
+		}
+
+		// The document may have changed since it was read, in which case
+		// read it and run change again.
+		rec := revisionRecord{Time: at.UnixNano(), Writer: writerID(writer), Key: key}
+
+		idx, ok, err := m.commit(rec, token, space, blob, data)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		m.publish(&Change{
+			Token: token,
+			Space: space,
+			Key:   key,
+			Value: val,
+			Index: idx,
+		})
+
+		return nil
 	}
+}
+
+// Subscribe registers fn to be called with every change made by Set.
+func (m *MsgpackBackend) Subscribe(fn func(*Change)) {
+	m.subLock.Lock()
+	defer m.subLock.Unlock()
+
+	m.subscribers = append(m.subscribers, fn)
+}
+
+func (m *MsgpackBackend) publish(c *Change) {
+	m.subLock.Lock()
+	subscribers := m.subscribers
+	m.subLock.Unlock()
 
-	if doc == nil {
-		doc = make(map[string]interface{})
+	for _, fn := range subscribers {
+		fn(c)
 	}
+}
 
-	parts := strings.Split(key, ".")
+// indexSpace names the blob that holds the change index of space. It
+// sits next to the space itself, hidden behind a leading dot.
+func indexSpace(space string) string {
+	return ".index." + space
+}
 
-	key = parts[len(parts)-1]
+// Index returns the change index of a space, which is incremented on
+// every write. A space that has never been written to is at index 0.
+func (m *MsgpackBackend) Index(token, space string) (uint64, error) {
+	blob, err := m.store.Get(token, indexSpace(space))
+	if err != nil {
+		return 0, err
+	}
 
-	var pos map[string]interface{}
+	return decodeIndex(blob)
+}
 
-	if len(parts) == 1 {
-		pos = doc
-	} else {
-		pos, err = m.findSub(doc, parts[:len(parts)-1])
+func encodeIndex(idx uint64) ([]byte, error) {
+	var blob []byte
+
+	err := codec.NewEncoderBytes(&blob, msgpackHandle).Encode(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+func decodeIndex(blob []byte) (uint64, error) {
+	if blob == nil {
+		return 0, nil
+	}
+
+	var idx uint64
+
+	err := codec.NewDecoderBytes(blob, msgpackHandle).Decode(&idx)
+	if err != nil {
+		return 0, err
+	}
+
+	return idx, nil
+}
+
+// List returns the spaces of a token, sorted, leaving out the blobs kept
+// next to them such as their index and history.
+func (m *MsgpackBackend) List(token string) ([]string, error) {
+	names, err := m.store.List(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var spaces []string
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			spaces = append(spaces, name)
+		}
+	}
+
+	sort.Strings(spaces)
+
+	return spaces, nil
+}
+
+// DeleteSpace drops a space along with its history and revisions. Its
+// change index is kept and bumped for the delete, so watches see it and a
+// space written to again carries on from there. If cond is given, the
+// current document must meet it.
+func (m *MsgpackBackend) DeleteSpace(token, space string, cond *Precondition) error {
+	defer m.lock(token, space)()
+
+	if cond != nil {
+		blob, err := m.store.Get(token, space)
 		if err != nil {
 			return err
 		}
+
+		var cur interface{}
+
+		if blob != nil {
+			cur, err = m.lookup(blob, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		if !cond.Met(cur) {
+			return ErrPreconditionFailed
+		}
 	}
 
-	if val == nil {
-		delete(pos, key)
-		m.prune(doc)
-	} else {
-		pos[key] = val
+	names, err := m.store.List(token)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if name != indexSpace(space) && isCompanion(name, space) {
+			err = m.store.Delete(token, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = m.store.Delete(token, space)
+	if err != nil {
+		return err
+	}
+
+	idx, err := m.Index(token, space)
+	if err != nil {
+		return err
+	}
+
+	idx++
+
+	blob, err := encodeIndex(idx)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.Set(token, indexSpace(space), blob)
+	if err != nil {
+		return err
 	}
 
-	var data []byte
+	m.publish(&Change{
+		Token: token,
+		Space: space,
+		Index: idx,
+	})
+
+	return nil
+}
 
-	err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(doc)
+// DeleteToken drops every space of a token.
+func (m *MsgpackBackend) DeleteToken(token string) error {
+	spaces, err := m.List(token)
 	if err != nil {
 		return err
 	}
 
-	return m.store.Set(token, space, data)
+	for _, space := range spaces {
+		err = m.DeleteSpace(token, space, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Anything left over, such as the history of a space whose document
+	// was lost, goes too.
+	names, err := m.store.List(token)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = m.store.Delete(token, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (m *MsgpackBackend) Get(token, space, key string) (interface{}, error) {
@@ -169,13 +550,19 @@ func (m *MsgpackBackend) Get(token, space, key string) (interface{}, error) {
 		return nil, err
 	}
 
+	return m.lookup(blob, key)
+}
+
+// lookup decodes a document blob and returns the value at key in it, or
+// the whole document if key is empty.
+func (m *MsgpackBackend) lookup(blob []byte, key string) (interface{}, error) {
 	if blob == nil {
 		return nil, nil
 	}
 
 	var doc map[string]interface{}
 
-	err = codec.NewDecoderBytes(blob, msgpackHandle).Decode(&doc)
+	err := codec.NewDecoderBytes(blob, msgpackHandle).Decode(&doc)
 	if err != nil {
 		return nil, err
 	}
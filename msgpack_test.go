@@ -1,9 +1,16 @@
 package datum
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/ugorji/go/codec"
 	"github.com/vektra/neko"
@@ -19,9 +26,31 @@ func TestMsgpackBackend(t *testing.T) {
 	n.CheckMock(&ms.Mock)
 
 	n.Setup(func() {
-		mp = &MsgpackBackend{&ms}
+		mp = NewMsgpackBackend(&ms)
 	})
 
+	encode := func(v interface{}) []byte {
+		var data []byte
+
+		err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+		require.NoError(t, err)
+
+		return data
+	}
+
+	expectIndexBump := func() {
+		var data []byte
+
+		err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(uint64(1))
+		require.NoError(t, err)
+
+		ms.On("Get", "aabbcc", ".index.default").Return([]byte(nil), nil)
+		ms.On("Set", "aabbcc", ".index.default", data).Return(nil)
+		ms.On("Set", "aabbcc", ".rev.default.1", mock.Anything).Return(nil)
+		ms.On("Get", "aabbcc", ".history.default").Return([]byte(nil), nil)
+		ms.On("Set", "aabbcc", ".history.default", mock.Anything).Return(nil)
+	}
+
 	n.It("stores new keys", func() {
 		var data []byte
 
@@ -31,7 +60,9 @@ func TestMsgpackBackend(t *testing.T) {
 		require.NoError(t, err)
 
 		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil)
-		ms.On("Set", "aabbcc", "default", data).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah", "foo")
 		require.NoError(t, err)
@@ -54,7 +85,9 @@ func TestMsgpackBackend(t *testing.T) {
 		err = codec.NewEncoderBytes(&data2, msgpackHandle).Encode(doc)
 		require.NoError(t, err)
 
-		ms.On("Set", "aabbcc", "default", data2).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data2).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah", "foo")
 		require.NoError(t, err)
@@ -73,7 +106,9 @@ func TestMsgpackBackend(t *testing.T) {
 		require.NoError(t, err)
 
 		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil)
-		ms.On("Set", "aabbcc", "default", data).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "sub.blah", "foo")
 		require.NoError(t, err)
@@ -96,7 +131,9 @@ func TestMsgpackBackend(t *testing.T) {
 		err = codec.NewEncoderBytes(&data2, msgpackHandle).Encode(doc)
 		require.NoError(t, err)
 
-		ms.On("Set", "aabbcc", "default", data2).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data2).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah", nil)
 		require.NoError(t, err)
@@ -121,7 +158,9 @@ func TestMsgpackBackend(t *testing.T) {
 		err = codec.NewEncoderBytes(&data2, msgpackHandle).Encode(doc)
 		require.NoError(t, err)
 
-		ms.On("Set", "aabbcc", "default", data2).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data2).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah.bar", nil)
 		require.NoError(t, err)
@@ -146,7 +185,9 @@ func TestMsgpackBackend(t *testing.T) {
 		err = codec.NewEncoderBytes(&data2, msgpackHandle).Encode(doc)
 		require.NoError(t, err)
 
-		ms.On("Set", "aabbcc", "default", data2).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data2).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah.bar", nil)
 		require.NoError(t, err)
@@ -169,7 +210,9 @@ func TestMsgpackBackend(t *testing.T) {
 		err = codec.NewEncoderBytes(&data2, msgpackHandle).Encode(doc)
 		require.NoError(t, err)
 
-		ms.On("Set", "aabbcc", "default", data2).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data2).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah", "foo")
 		require.NoError(t, err)
@@ -242,7 +285,9 @@ func TestMsgpackBackend(t *testing.T) {
 		require.NoError(t, err)
 
 		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil)
-		ms.On("Set", "aabbcc", "default", data).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data).Return(true, nil)
+
+		expectIndexBump()
 
 		err = mp.Set("aabbcc", "default", "blah", encVal)
 		require.NoError(t, err)
@@ -266,5 +311,671 @@ func TestMsgpackBackend(t *testing.T) {
 		assert.Equal(t, *encVal, val)
 	})
 
+	n.It("sets a key if its precondition is met", func() {
+		old := map[string]interface{}{"blah": "foo"}
+		doc := map[string]interface{}{"blah": "bar"}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", encode(old), encode(doc)).Return(true, nil)
+		expectIndexBump()
+
+		cond := &Precondition{IfMatch: ETag("foo")}
+
+		err := mp.SetIf("aabbcc", "aabbcc", "default", "blah", "bar", cond)
+		require.NoError(t, err)
+	})
+
+	n.It("refuses to set a key if its precondition isn't met", func() {
+		old := map[string]interface{}{"blah": "foo"}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+
+		cond := &Precondition{IfNoneMatch: "*"}
+
+		err := mp.SetIf("aabbcc", "aabbcc", "default", "blah", "bar", cond)
+		assert.Equal(t, ErrPreconditionFailed, err)
+	})
+
+	n.It("checks a precondition again if the document changed", func() {
+		old := map[string]interface{}{"blah": "foo"}
+		changed := map[string]interface{}{"blah": "qux"}
+		doc := map[string]interface{}{"blah": "bar"}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil).Once()
+		ms.On("Get", "aabbcc", ".index.default").Return([]byte(nil), nil)
+		ms.On("Get", "aabbcc", ".history.default").Return([]byte(nil), nil)
+		ms.On("Set", "aabbcc", ".rev.default.1", encode(doc)).Return(nil)
+		ms.On("CompareAndSet", "aabbcc", "default", encode(old), encode(doc)).Return(false, nil)
+		ms.On("Get", "aabbcc", "default").Return(encode(changed), nil)
+
+		cond := &Precondition{IfMatch: ETag("foo")}
+
+		err := mp.SetIf("aabbcc", "aabbcc", "default", "blah", "bar", cond)
+		assert.Equal(t, ErrPreconditionFailed, err)
+	})
+
+	decoded := func(expected map[string]interface{}) interface{} {
+		return mock.MatchedBy(func(data []byte) bool {
+			var doc map[string]interface{}
+
+			err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&doc)
+
+			return err == nil && assert.ObjectsAreEqual(expected, doc)
+		})
+	}
+
+	n.It("replaces a whole document", func() {
+		old := map[string]interface{}{"blah": "foo"}
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "bar"},
+		}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, decoded(doc)).Return(true, nil)
+		expectIndexBump()
+
+		err := mp.Update("aabbcc", "aabbcc", "default", doc, false, nil)
+		require.NoError(t, err)
+	})
+
+	n.It("deep merges a document into the existing one", func() {
+		old := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "foo", "gone": "soon"},
+		}
+
+		doc := map[string]interface{}{
+			"sub": map[string]interface{}{"blah": "bar", "gone": nil},
+			"new": "qux",
+		}
+
+		merged := map[string]interface{}{
+			"name": "vektra",
+			"sub":  map[string]interface{}{"blah": "bar"},
+			"new":  "qux",
+		}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, decoded(merged)).Return(true, nil)
+		expectIndexBump()
+
+		err := mp.Update("aabbcc", "aabbcc", "default", doc, true, nil)
+		require.NoError(t, err)
+	})
+
+	n.It("refuses to update a document if its precondition isn't met", func() {
+		old := map[string]interface{}{"blah": "foo"}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+
+		cond := &Precondition{IfNoneMatch: "*"}
+
+		doc := map[string]interface{}{"blah": "bar"}
+
+		err := mp.Update("aabbcc", "aabbcc", "default", doc, false, cond)
+		assert.Equal(t, ErrPreconditionFailed, err)
+	})
+
+	n.It("applies a json patch to a document", func() {
+		old := map[string]interface{}{"list": []interface{}{"foo"}}
+		doc := map[string]interface{}{"list": []interface{}{"foo", "bar"}}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, encode(doc)).Return(true, nil)
+		expectIndexBump()
+
+		ops := []PatchOp{{Op: "add", Path: "/list/-", Value: "bar"}}
+
+		err := mp.Patch("aabbcc", "aabbcc", "default", ops, nil)
+		require.NoError(t, err)
+	})
+
+	n.It("prunes the maps a json patch leaves empty", func() {
+		old := map[string]interface{}{
+			"db":   map[string]interface{}{"host": "localhost"},
+			"name": "vektra",
+		}
+
+		doc := map[string]interface{}{"name": "vektra"}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, encode(doc)).Return(true, nil)
+		expectIndexBump()
+
+		ops := []PatchOp{{Op: "remove", Path: "/db/host"}}
+
+		err := mp.Patch("aabbcc", "aabbcc", "default", ops, nil)
+		require.NoError(t, err)
+	})
+
+	n.It("leaves a document alone if any of a patch fails", func() {
+		old := map[string]interface{}{"blah": "foo"}
+
+		ms.On("Get", "aabbcc", "default").Return(encode(old), nil)
+
+		ops := []PatchOp{
+			{Op: "replace", Path: "/blah", Value: "bar"},
+			{Op: "test", Path: "/blah", Value: "foo"},
+		}
+
+		err := mp.Patch("aabbcc", "aabbcc", "default", ops, nil)
+		assert.IsType(t, &PatchError{}, err)
+	})
+
+	n.It("starts new spaces at index 0", func() {
+		ms.On("Get", "aabbcc", ".index.default").Return([]byte(nil), nil)
+
+		idx, err := mp.Index("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, uint64(0), idx)
+	})
+
+	n.It("increments the index of a space on set", func() {
+		var data, data2, idx []byte
+
+		err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(map[string]interface{}{})
+		require.NoError(t, err)
+
+		err = codec.NewEncoderBytes(&data2, msgpackHandle).Encode(map[string]interface{}{"blah": "foo"})
+		require.NoError(t, err)
+
+		err = codec.NewEncoderBytes(&idx, msgpackHandle).Encode(uint64(4))
+		require.NoError(t, err)
+
+		var idx2 []byte
+
+		err = codec.NewEncoderBytes(&idx2, msgpackHandle).Encode(uint64(5))
+		require.NoError(t, err)
+
+		ms.On("Get", "aabbcc", "default").Return(data, nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, data2).Return(true, nil)
+		ms.On("Get", "aabbcc", ".index.default").Return(idx, nil)
+		ms.On("Set", "aabbcc", ".index.default", idx2).Return(nil)
+		ms.On("Set", "aabbcc", ".rev.default.5", data2).Return(nil)
+		ms.On("Get", "aabbcc", ".history.default").Return([]byte(nil), nil)
+		ms.On("Set", "aabbcc", ".history.default", mock.Anything).Return(nil)
+
+		err = mp.Set("aabbcc", "default", "blah", "foo")
+		require.NoError(t, err)
+	})
+
+	n.It("publishes changes to subscribers", func() {
+		var change *Change
+
+		mp.Subscribe(func(c *Change) {
+			change = c
+		})
+
+		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, mock.Anything).Return(true, nil)
+		expectIndexBump()
+
+		err := mp.Set("aabbcc", "default", "sub.blah", "foo")
+		require.NoError(t, err)
+
+		expected := &Change{
+			Token: "aabbcc",
+			Space: "default",
+			Key:   "sub.blah",
+			Value: "foo",
+			Index: 1,
+		}
+
+		assert.Equal(t, expected, change)
+	})
+
+	n.It("keeps every write as a revision", func() {
+		t1 := time.Unix(100, 0).UnixNano()
+
+		history := []revisionRecord{
+			{Index: 1, Time: t1, Writer: writerID("aabbcc"), Key: "name"},
+		}
+
+		doc := map[string]interface{}{"blah": "foo"}
+
+		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, encode(doc)).Return(true, nil)
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(1)), nil)
+		ms.On("Set", "aabbcc", ".index.default", encode(uint64(2))).Return(nil)
+		ms.On("Set", "aabbcc", ".rev.default.2", encode(doc)).Return(nil)
+		ms.On("Get", "aabbcc", ".history.default").Return(encode(history), nil)
+
+		var written []revisionRecord
+
+		ms.On("Set", "aabbcc", ".history.default", mock.Anything).Run(func(args mock.Arguments) {
+			err := codec.NewDecoderBytes(args.Get(2).([]byte), msgpackHandle).Decode(&written)
+			require.NoError(t, err)
+		}).Return(nil)
+
+		err := mp.SetBy("a-ddeeff", "aabbcc", "default", "blah", "foo")
+		require.NoError(t, err)
+
+		require.Equal(t, 2, len(written))
+
+		assert.Equal(t, history[0], written[0])
+		assert.Equal(t, uint64(2), written[1].Index)
+		assert.Equal(t, writerID("a-ddeeff"), written[1].Writer)
+		assert.Equal(t, "blah", written[1].Key)
+	})
+
+	n.It("writes a document in the same batch as its revision", func() {
+		mp = NewMsgpackBackend(batchBlobStore{&ms})
+
+		old := encode(map[string]interface{}{"name": "vektra"})
+		doc := map[string]interface{}{"name": "vektra", "blah": "foo"}
+
+		// Maps encode in no set order, so the blobs are compared decoded.
+		isDoc := func(data []byte) bool {
+			var val map[string]interface{}
+
+			err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&val)
+
+			return err == nil && assert.ObjectsAreEqual(doc, val)
+		}
+
+		ms.On("Get", "aabbcc", "default").Return(old, nil)
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(1)), nil)
+		ms.On("Get", "aabbcc", ".history.default").Return([]byte(nil), nil)
+
+		expect := map[string][]byte{
+			"default":        old,
+			".index.default": encode(uint64(1)),
+		}
+
+		ms.On("CompareAndSetBatch", "aabbcc", expect, mock.MatchedBy(func(blobs map[string][]byte) bool {
+			return len(blobs) == 4 &&
+				isDoc(blobs["default"]) &&
+				isDoc(blobs[".rev.default.2"]) &&
+				bytes.Equal(blobs[".index.default"], encode(uint64(2)))
+		})).Return(true, nil)
+
+		err := mp.Set("aabbcc", "default", "blah", "foo")
+		require.NoError(t, err)
+	})
+
+	n.It("starts over if a batch finds the document changed", func() {
+		mp = NewMsgpackBackend(batchBlobStore{&ms})
+
+		changed := encode(map[string]interface{}{"name": "other"})
+
+		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil).Once()
+		ms.On("Get", "aabbcc", "default").Return(changed, nil)
+		ms.On("Get", "aabbcc", ".index.default").Return([]byte(nil), nil).Once()
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(1)), nil)
+		ms.On("Get", "aabbcc", ".history.default").Return([]byte(nil), nil)
+
+		var written map[string][]byte
+
+		ms.On("CompareAndSetBatch", "aabbcc", mock.Anything, mock.Anything).Return(false, nil).Once()
+		ms.On("CompareAndSetBatch", "aabbcc", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			written = args.Get(2).(map[string][]byte)
+		}).Return(true, nil)
+
+		err := mp.Set("aabbcc", "default", "blah", "foo")
+		require.NoError(t, err)
+
+		var doc map[string]interface{}
+
+		err = codec.NewDecoderBytes(written["default"], msgpackHandle).Decode(&doc)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]interface{}{"name": "other", "blah": "foo"}, doc)
+		assert.Equal(t, encode(uint64(2)), written[".index.default"])
+	})
+
+	n.It("drops the oldest revisions past MaxRevisions", func() {
+		mp.MaxRevisions = 2
+
+		history := []revisionRecord{
+			{Index: 1, Key: "name"},
+			{Index: 2, Key: "name"},
+		}
+
+		doc := map[string]interface{}{"blah": "foo"}
+
+		ms.On("Get", "aabbcc", "default").Return([]byte(nil), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", mock.Anything, encode(doc)).Return(true, nil)
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(2)), nil)
+		ms.On("Set", "aabbcc", ".index.default", encode(uint64(3))).Return(nil)
+		ms.On("Set", "aabbcc", ".rev.default.3", encode(doc)).Return(nil)
+		ms.On("Get", "aabbcc", ".history.default").Return(encode(history), nil)
+		ms.On("Delete", "aabbcc", ".rev.default.1").Return(nil)
+
+		var written []revisionRecord
+
+		ms.On("Set", "aabbcc", ".history.default", mock.Anything).Run(func(args mock.Arguments) {
+			err := codec.NewDecoderBytes(args.Get(2).([]byte), msgpackHandle).Decode(&written)
+			require.NoError(t, err)
+		}).Return(nil)
+
+		err := mp.Set("aabbcc", "default", "blah", "foo")
+		require.NoError(t, err)
+
+		require.Equal(t, 2, len(written))
+
+		assert.Equal(t, uint64(2), written[0].Index)
+		assert.Equal(t, uint64(3), written[1].Index)
+	})
+
+	n.It("keeps no history for the reserved token", func() {
+		ms.On("Get", "_", "views").Return([]byte(nil), nil)
+		ms.On("CompareAndSet", "_", "views", mock.Anything, mock.Anything).Return(true, nil)
+		ms.On("Get", "_", ".index.views").Return([]byte(nil), nil)
+		ms.On("Set", "_", ".index.views", encode(uint64(1))).Return(nil)
+
+		err := mp.Set("_", "views", "v-ddeeff", "aabbcc")
+		require.NoError(t, err)
+	})
+
+	n.It("rolls a space back to an old revision", func() {
+		old := map[string]interface{}{"blah": "foo"}
+
+		cur := map[string]interface{}{"blah": "bar"}
+
+		ms.On("Get", "aabbcc", ".rev.default.1").Return(encode(old), nil)
+		ms.On("Get", "aabbcc", "default").Return(encode(cur), nil)
+		ms.On("CompareAndSet", "aabbcc", "default", encode(cur), encode(old)).Return(true, nil)
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(4)), nil)
+		ms.On("Set", "aabbcc", ".index.default", encode(uint64(5))).Return(nil)
+		ms.On("Set", "aabbcc", ".rev.default.5", encode(old)).Return(nil)
+		ms.On("Get", "aabbcc", ".history.default").Return([]byte(nil), nil)
+
+		var written []revisionRecord
+
+		ms.On("Set", "aabbcc", ".history.default", mock.Anything).Run(func(args mock.Arguments) {
+			err := codec.NewDecoderBytes(args.Get(2).([]byte), msgpackHandle).Decode(&written)
+			require.NoError(t, err)
+		}).Return(nil)
+
+		idx, err := mp.Rollback("aabbcc", "aabbcc", "default", 1)
+		require.NoError(t, err)
+
+		assert.Equal(t, uint64(5), idx)
+
+		require.Equal(t, 1, len(written))
+		assert.Equal(t, uint64(5), written[0].Index)
+		assert.Equal(t, uint64(1), written[0].From)
+	})
+
+	n.It("refuses to roll back to a missing revision", func() {
+		ms.On("Get", "aabbcc", ".rev.default.1").Return([]byte(nil), nil)
+
+		_, err := mp.Rollback("aabbcc", "aabbcc", "default", 1)
+		assert.Equal(t, ErrNoRevision, err)
+	})
+
+	n.It("returns the history of a space", func() {
+		history := []revisionRecord{
+			{Index: 1, Time: time.Unix(100, 0).UnixNano(), Writer: "3b6a47d1", Key: "name"},
+			{Index: 2, Time: time.Unix(200, 0).UnixNano(), Writer: "9c1185a5", Key: "blah"},
+		}
+
+		ms.On("Get", "aabbcc", ".history.default").Return(encode(history), nil)
+
+		revs, err := mp.History("aabbcc", "default")
+		require.NoError(t, err)
+
+		expected := []*Revision{
+			{Index: 1, Time: time.Unix(100, 0), Writer: "3b6a47d1", Key: "name"},
+			{Index: 2, Time: time.Unix(200, 0), Writer: "9c1185a5", Key: "blah"},
+		}
+
+		assert.Equal(t, expected, revs)
+	})
+
+	n.It("gets values from an old revision", func() {
+		doc := map[string]interface{}{"blah": "foo"}
+
+		ms.On("Get", "aabbcc", ".rev.default.3").Return(encode(doc), nil)
+
+		val, err := mp.GetRevision("aabbcc", "default", 3, "blah")
+		require.NoError(t, err)
+
+		assert.Equal(t, "foo", val)
+	})
+
+	n.It("reports missing revisions", func() {
+		ms.On("Get", "aabbcc", ".rev.default.3").Return([]byte(nil), nil)
+
+		_, err := mp.GetRevision("aabbcc", "default", 3, "blah")
+		assert.Equal(t, ErrNoRevision, err)
+	})
+
+	n.It("finds the revision a space was at during a time", func() {
+		history := []revisionRecord{
+			{Index: 1, Time: time.Unix(100, 0).UnixNano()},
+			{Index: 2, Time: time.Unix(200, 0).UnixNano()},
+		}
+
+		ms.On("Get", "aabbcc", ".history.default").Return(encode(history), nil)
+
+		rev, err := mp.RevisionAt("aabbcc", "default", time.Unix(150, 0))
+		require.NoError(t, err)
+
+		assert.Equal(t, uint64(1), rev)
+
+		_, err = mp.RevisionAt("aabbcc", "default", time.Unix(50, 0))
+		assert.Equal(t, ErrNoRevision, err)
+	})
+
+	n.It("lists spaces without their companion blobs", func() {
+		ms.On("List", "aabbcc").Return([]string{"web", ".index.web", "db", ".history.db"}, nil)
+
+		spaces, err := mp.List("aabbcc")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"db", "web"}, spaces)
+	})
+
+	n.It("deletes a space with its history and revisions, bumping its index", func() {
+		names := []string{
+			"default", ".index.default", ".history.default",
+			".rev.default.1", ".rev.default.2",
+			"other", ".index.other", ".rev.other.1",
+		}
+
+		ms.On("List", "aabbcc").Return(names, nil)
+
+		for _, name := range []string{"default", ".history.default", ".rev.default.1", ".rev.default.2"} {
+			ms.On("Delete", "aabbcc", name).Return(nil)
+		}
+
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(2)), nil)
+		ms.On("Set", "aabbcc", ".index.default", encode(uint64(3))).Return(nil)
+
+		var changes []*Change
+
+		mp.Subscribe(func(c *Change) {
+			changes = append(changes, c)
+		})
+
+		err := mp.DeleteSpace("aabbcc", "default", nil)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(changes))
+
+		assert.Equal(t, "default", changes[0].Space)
+		assert.Nil(t, changes[0].Value)
+		assert.Equal(t, uint64(3), changes[0].Index)
+	})
+
+	n.It("only deletes a space that meets the precondition", func() {
+		ms.On("Get", "aabbcc", "default").Return(encode(map[string]interface{}{"blah": "foo"}), nil)
+
+		err := mp.DeleteSpace("aabbcc", "default", &Precondition{IfNoneMatch: "*"})
+		assert.Equal(t, ErrPreconditionFailed, err)
+	})
+
+	n.It("deletes every space of a token", func() {
+		ms.On("List", "aabbcc").Return([]string{"default", ".index.default", ".history.gone"}, nil).Once()
+		ms.On("List", "aabbcc").Return([]string{"default", ".index.default", ".history.gone"}, nil).Once()
+		ms.On("Delete", "aabbcc", "default").Return(nil)
+		ms.On("Get", "aabbcc", ".index.default").Return(encode(uint64(1)), nil)
+		ms.On("Set", "aabbcc", ".index.default", encode(uint64(2))).Return(nil)
+		ms.On("List", "aabbcc").Return([]string{".index.default", ".history.gone"}, nil).Once()
+		ms.On("Delete", "aabbcc", ".index.default").Return(nil)
+		ms.On("Delete", "aabbcc", ".history.gone").Return(nil)
+
+		err := mp.DeleteToken("aabbcc")
+		require.NoError(t, err)
+	})
+
+	n.Meow()
+}
+
+func TestMsgpackBackendConcurrency(t *testing.T) {
+	n := neko.Start(t)
+
+	var (
+		mp  *MsgpackBackend
+		dir string
+	)
+
+	const (
+		writers = 8
+		keys    = 25
+	)
+
+	n.Setup(func() {
+		var err error
+
+		dir, err = ioutil.TempDir("", "msgpack")
+		require.NoError(t, err)
+
+		mp = NewMsgpackBackend(NewDiskStore(dir))
+
+		// Keep every revision, so none of them go missing unnoticed.
+		mp.MaxRevisions = 0
+	})
+
+	n.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	n.It("loses no keys when setting in parallel", func() {
+		var wg sync.WaitGroup
+
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < keys; j++ {
+					err := mp.Set("aabbcc", "default", fmt.Sprintf("w%d.k%d", i, j), "foo")
+					assert.NoError(t, err)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+
+		for i := 0; i < writers; i++ {
+			for j := 0; j < keys; j++ {
+				val, err := mp.Get("aabbcc", "default", fmt.Sprintf("w%d.k%d", i, j))
+				require.NoError(t, err)
+
+				assert.Equal(t, "foo", val, "w%d.k%d is missing", i, j)
+			}
+		}
+
+		idx, err := mp.Index("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, uint64(writers*keys), idx)
+
+		revs, err := mp.History("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, writers*keys, len(revs))
+	})
+
+	n.It("loses no keys when setting conditionally in parallel", func() {
+		var wg sync.WaitGroup
+
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < keys; j++ {
+					cond := &Precondition{IfNoneMatch: "*"}
+
+					err := mp.SetIf("aabbcc", "aabbcc", "default", fmt.Sprintf("w%d.k%d", i, j), "foo", cond)
+					assert.NoError(t, err)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+
+		doc, err := mp.Get("aabbcc", "default", "")
+		require.NoError(t, err)
+
+		total := 0
+
+		for _, sub := range doc.(map[string]interface{}) {
+			total += len(sub.(map[string]interface{}))
+		}
+
+		assert.Equal(t, writers*keys, total)
+	})
+
+	n.It("lets only one of several racing conditional sets win", func() {
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+			won  int
+		)
+
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				cond := &Precondition{IfNoneMatch: "*"}
+
+				err := mp.SetIf("aabbcc", "aabbcc", "default", "leader", fmt.Sprintf("w%d", i), cond)
+				if err == nil {
+					lock.Lock()
+					won++
+					lock.Unlock()
+				} else {
+					assert.Equal(t, ErrPreconditionFailed, err)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, 1, won)
+	})
+
 	n.Meow()
 }
+
+// batchBlobStore is a MockBlobStore that's also a BatchStore.
+type batchBlobStore struct {
+	*MockBlobStore
+}
+
+func (b batchBlobStore) SetBatch(token string, blobs map[string][]byte) error {
+	ret := b.Called(token, blobs)
+
+	r0 := ret.Error(0)
+
+	return r0
+}
+
+func (b batchBlobStore) CompareAndSetBatch(token string, old map[string][]byte, blobs map[string][]byte) (bool, error) {
+	ret := b.Called(token, old, blobs)
+
+	r0 := ret.Get(0).(bool)
+	r1 := ret.Error(1)
+
+	return r0, r1
+}
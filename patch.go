@@ -0,0 +1,453 @@
+package datum
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PatchOp is one operation of a JSON Patch (RFC 6902).
+type PatchOp struct {
+	Op    string      `json:"op" codec:"op"`
+	Path  string      `json:"path" codec:"path"`
+	From  string      `json:"from" codec:"from"`
+	Value interface{} `json:"value" codec:"value"`
+}
+
+const patchErrorPrefix = "unable to apply patch: "
+
+// PatchError is returned when a JSON Patch doesn't apply to a document,
+// such as when a path is missing or a test fails.
+type PatchError struct {
+	Msg string
+}
+
+func (e *PatchError) Error() string {
+	return patchErrorPrefix + e.Msg
+}
+
+// Patcher is implemented by Backends that can apply a JSON Patch to a
+// document. HTTPApi needs it for PATCH with application/json-patch+json.
+type Patcher interface {
+	Patch(writer string, token string, space string, ops []PatchOp, cond *Precondition) error
+}
+
+// Patch applies ops to the document of space in a single write. Either
+// every op applies or the document is left alone and a *PatchError is
+// returned. Maps left empty are dropped, as they are by Set. If cond is
+// given, the current document must meet it.
+func (m *MsgpackBackend) Patch(writer, token, space string, ops []PatchOp, cond *Precondition) error {
+	return m.patch(time.Now(), writer, token, space, ops, cond)
+}
+
+// patch is Patch, recording the change as made at the time at.
+func (m *MsgpackBackend) patch(at time.Time, writer, token, space string, ops []PatchOp, cond *Precondition) error {
+	return m.write(at, writer, token, space, "", func(cur map[string]interface{}) (map[string]interface{}, interface{}, error) {
+		if cond != nil {
+			var val interface{}
+
+			if cur != nil {
+				val = cur
+			}
+
+			if !cond.Met(val) {
+				return nil, nil, ErrPreconditionFailed
+			}
+		}
+
+		if cur == nil {
+			cur = make(map[string]interface{})
+		}
+
+		doc, err := applyPatch(cur, ops)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m.prune(doc)
+
+		return doc, doc, nil
+	})
+}
+
+// applyPatch applies ops to doc, which it may modify along the way.
+func applyPatch(doc map[string]interface{}, ops []PatchOp) (map[string]interface{}, error) {
+	var root interface{} = doc
+
+	for _, op := range ops {
+		var err error
+
+		root, err = applyPatchOp(root, op)
+		if err != nil {
+			return nil, &PatchError{fmt.Sprintf("%s %s: %s", op.Op, op.Path, err)}
+		}
+	}
+
+	doc, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, &PatchError{"document is no longer a map"}
+	}
+
+	return doc, nil
+}
+
+func applyPatchOp(root interface{}, op PatchOp) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return patchAdd(root, path, op.Value)
+	case "remove":
+		return patchRemove(root, path)
+	case "replace":
+		if _, err := pointerGet(root, path); err != nil {
+			return nil, err
+		}
+
+		return patchAdd(root, path, op.Value)
+	case "move":
+		if op.From == op.Path {
+			return root, nil
+		}
+
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("can't move a value into itself")
+		}
+
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := pointerGet(root, from)
+		if err != nil {
+			return nil, err
+		}
+
+		root, err = patchRemove(root, from)
+		if err != nil {
+			return nil, err
+		}
+
+		return patchAdd(root, path, val)
+	case "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := pointerGet(root, from)
+		if err != nil {
+			return nil, err
+		}
+
+		return patchAdd(root, path, copyValue(val))
+	case "test":
+		val, err := pointerGet(root, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !jsonEqual(val, op.Value) {
+			return nil, errors.New("test failed")
+		}
+
+		return root, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference
+// tokens. The empty pointer refers to the whole document.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q", ptr)
+	}
+
+	tokens := strings.Split(ptr[1:], "/")
+
+	for i, tok := range tokens {
+		tok = strings.Replace(tok, "~1", "/", -1)
+		tokens[i] = strings.Replace(tok, "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses tok as an index into a list of size elements. With
+// end set, the index just past the last element is allowed too.
+func arrayIndex(tok string, size int, end bool) (int, error) {
+	if end && tok == "-" {
+		return size, nil
+	}
+
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (tok != "0" && tok[0] == '0') {
+		return 0, fmt.Errorf("invalid index %q", tok)
+	}
+
+	if i > size || (i == size && !end) {
+		return 0, fmt.Errorf("index %d out of range", i)
+	}
+
+	return i, nil
+}
+
+func pointerGet(node interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			val, ok := n[tok]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", tok)
+			}
+
+			node = val
+		case []interface{}:
+			i, err := arrayIndex(tok, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%s not found", tok)
+		}
+	}
+
+	return node, nil
+}
+
+// modifyAt calls fn with the map or list holding the value at path and the
+// last token of path, and puts whatever fn returns in that map or list's
+// place.
+func modifyAt(node interface{}, path []string, fn func(parent interface{}, tok string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", path[0])
+		}
+
+		sub, err := modifyAt(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+
+		n[path[0]] = sub
+
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(n), false)
+		if err != nil {
+			return nil, err
+		}
+
+		sub, err := modifyAt(n[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+
+		n[i] = sub
+
+		return n, nil
+	default:
+		return nil, fmt.Errorf("%s not found", path[0])
+	}
+}
+
+func patchAdd(root interface{}, path []string, val interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+
+	return modifyAt(root, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[tok] = val
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = val
+
+			return p, nil
+		default:
+			return nil, fmt.Errorf("can't add to a %T", parent)
+		}
+	})
+}
+
+func patchRemove(root interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+
+	return modifyAt(root, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[tok]; !ok {
+				return nil, fmt.Errorf("%s not found", tok)
+			}
+
+			delete(p, tok)
+
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(p[:i], p[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%s not found", tok)
+		}
+	})
+}
+
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+
+		for k, sub := range v {
+			m[k] = copyValue(sub)
+		}
+
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+
+		for i, sub := range v {
+			list[i] = copyValue(sub)
+		}
+
+		return list
+	default:
+		return v
+	}
+}
+
+// jsonEqual reports if a and b are the same once rendered as JSON, so that
+// the int64s of a stored document equal the float64s of a decoded patch.
+func jsonEqual(a, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(ja, jb)
+}
+
+func (h *HTTPApi) patch1(w http.ResponseWriter, req *http.Request) {
+	var (
+		token = req.URL.Query().Get(":token")
+		space = req.URL.Query().Get(":space")
+	)
+
+	h.patch(token, space, w, req)
+}
+
+func (h *HTTPApi) patch2(w http.ResponseWriter, req *http.Request) {
+	var (
+		headerToken = req.Header.Get("Config-Token")
+		space       = req.URL.Query().Get(":space")
+	)
+
+	h.patch(headerToken, space, w, req)
+}
+
+// patch applies a JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902) to
+// a space, depending on the Content-Type of the request.
+func (h *HTTPApi) patch(token, space string, w http.ResponseWriter, req *http.Request) {
+	writer := token
+
+	token, ok := h.authorize(w, token, space, "", CapWrite)
+	if !ok {
+		return
+	}
+
+	cond := requestPrecondition(req)
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	var err error
+
+	switch mediaType {
+	case "application/merge-patch+json":
+		var doc map[string]interface{}
+
+		err = json.NewDecoder(req.Body).Decode(&doc)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		updater, ok := h.be.(Updater)
+		if !ok {
+			notImplemented(w, "merge patches")
+			return
+		}
+
+		err = updater.Update(writer, token, space, doc, true, cond)
+	case "application/json-patch+json":
+		var ops []PatchOp
+
+		err = json.NewDecoder(req.Body).Decode(&ops)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		patcher, ok := h.be.(Patcher)
+		if !ok {
+			notImplemented(w, "JSON patches")
+			return
+		}
+
+		err = patcher.Patch(writer, token, space, ops, cond)
+	default:
+		http.Error(w, "patch must be application/merge-patch+json or application/json-patch+json", 415)
+		return
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.consume(writer)
+
+	if !h.published {
+		h.hub.notify(token, space)
+	}
+}
@@ -0,0 +1,105 @@
+package datum
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestPatch(t *testing.T) {
+	n := neko.Start(t)
+
+	parse := func(s string) map[string]interface{} {
+		var doc map[string]interface{}
+
+		require.NoError(t, json.Unmarshal([]byte(s), &doc))
+
+		return doc
+	}
+
+	patch := func(doc, ops string) (map[string]interface{}, error) {
+		var parsed []PatchOp
+
+		require.NoError(t, json.Unmarshal([]byte(ops), &parsed))
+
+		return applyPatch(parse(doc), parsed)
+	}
+
+	n.It("adds values to maps and lists", func() {
+		doc, err := patch(`{"foo": ["bar", "baz"]}`, `[
+			{"op": "add", "path": "/foo/1", "value": "qux"},
+			{"op": "add", "path": "/foo/-", "value": "end"},
+			{"op": "add", "path": "/name", "value": "vektra"}
+		]`)
+		require.NoError(t, err)
+
+		assert.Equal(t, parse(`{"foo": ["bar", "qux", "baz", "end"], "name": "vektra"}`), doc)
+	})
+
+	n.It("removes and replaces values", func() {
+		doc, err := patch(`{"foo": ["bar", "baz"], "a": {"b": 1, "c": 2}}`, `[
+			{"op": "remove", "path": "/foo/0"},
+			{"op": "remove", "path": "/a/b"},
+			{"op": "replace", "path": "/a/c", "value": 3}
+		]`)
+		require.NoError(t, err)
+
+		assert.Equal(t, parse(`{"foo": ["baz"], "a": {"c": 3}}`), doc)
+	})
+
+	n.It("moves and copies values", func() {
+		doc, err := patch(`{"a": {"b": {"c": 1}}, "list": [1, 2]}`, `[
+			{"op": "copy", "from": "/a/b", "path": "/d"},
+			{"op": "move", "from": "/a/b/c", "path": "/a/e"},
+			{"op": "move", "from": "/list/0", "path": "/list/-"}
+		]`)
+		require.NoError(t, err)
+
+		assert.Equal(t, parse(`{"a": {"b": {}, "e": 1}, "d": {"c": 1}, "list": [2, 1]}`), doc)
+	})
+
+	n.It("unescapes pointers", func() {
+		doc, err := patch(`{"a/b": 1, "m~n": 2}`, `[
+			{"op": "replace", "path": "/a~1b", "value": 3},
+			{"op": "remove", "path": "/m~0n"}
+		]`)
+		require.NoError(t, err)
+
+		assert.Equal(t, parse(`{"a/b": 3}`), doc)
+	})
+
+	n.It("tests values regardless of their number types", func() {
+		doc := map[string]interface{}{"n": int64(1)}
+
+		_, err := applyPatch(doc, []PatchOp{{Op: "test", Path: "/n", Value: float64(1)}})
+		require.NoError(t, err)
+
+		_, err = applyPatch(doc, []PatchOp{{Op: "test", Path: "/n", Value: float64(2)}})
+		assert.IsType(t, &PatchError{}, err)
+	})
+
+	n.It("fails on missing paths", func() {
+		for _, ops := range []string{
+			`[{"op": "remove", "path": "/nope"}]`,
+			`[{"op": "replace", "path": "/nope", "value": 1}]`,
+			`[{"op": "add", "path": "/nope/deeper", "value": 1}]`,
+			`[{"op": "add", "path": "/foo/5", "value": 1}]`,
+			`[{"op": "move", "from": "/nope", "path": "/foo"}]`,
+			`[{"op": "bogus", "path": "/foo"}]`,
+			`[{"op": "add", "path": "foo", "value": 1}]`,
+		} {
+			_, err := patch(`{"foo": ["bar"]}`, ops)
+			assert.IsType(t, &PatchError{}, err, ops)
+		}
+	})
+
+	n.It("refuses to move a value into itself", func() {
+		_, err := patch(`{"a": {"b": 1}}`, `[{"op": "move", "from": "/a", "path": "/a/c"}]`)
+		assert.IsType(t, &PatchError{}, err)
+	})
+
+	n.Meow()
+}
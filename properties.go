@@ -0,0 +1,297 @@
+package datum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// renderProperties writes doc as a Java properties file, with one line per
+// dotted key path, sorted.
+func renderProperties(w io.Writer, doc map[string]interface{}) {
+	flat := make(map[string]string)
+
+	flattenPaths(flat, "", doc)
+
+	for _, k := range sortedKeys(flat) {
+		fmt.Fprintf(w, "%s=%s\n", escapeProperty(k, true), escapeProperty(flat[k], false))
+	}
+}
+
+// escapeProperty escapes s as a key or value of a properties file. Keys
+// also escape the characters that would end them, and values only their
+// leading space. Anything outside of ASCII is written as \uXXXX, since
+// properties files are Latin-1.
+func escapeProperty(s string, isKey bool) string {
+	var buf strings.Builder
+
+	for i, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case ' ':
+			if isKey || i == 0 {
+				buf.WriteString(`\ `)
+			} else {
+				buf.WriteRune(r)
+			}
+		case '=', ':', '#', '!':
+			if isKey || i == 0 {
+				buf.WriteByte('\\')
+			}
+
+			buf.WriteRune(r)
+		default:
+			if r < 0x20 || r > 0x7e {
+				if r > 0xffff {
+					r1, r2 := utf16.EncodeRune(r)
+					fmt.Fprintf(&buf, `\u%04x\u%04x`, r1, r2)
+				} else {
+					fmt.Fprintf(&buf, `\u%04x`, r)
+				}
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+// parseProperties reads a Java properties file, nesting its dotted keys
+// into a document. Every value is a string.
+func parseProperties(r io.Reader) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+
+	scanner := bufio.NewScanner(r)
+
+	var logical string
+
+	for scanner.Scan() {
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+
+		if logical == "" && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+
+		// An odd number of trailing backslashes continues the line.
+		if n := len(line) - len(strings.TrimRight(line, `\`)); n%2 == 1 {
+			logical += line[:len(line)-1]
+			continue
+		}
+
+		logical += line
+
+		key, val, err := splitProperty(logical)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setPath(doc, key, val)
+		if err != nil {
+			return nil, err
+		}
+
+		logical = ""
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if logical != "" {
+		key, val, err := splitProperty(logical)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setPath(doc, key, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// splitProperty splits a logical line into its unescaped key and value.
+// The key ends at the first unescaped =, : or whitespace.
+func splitProperty(line string) (string, string, error) {
+	end := len(line)
+
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+
+		if strings.IndexByte("=: \t\f", line[i]) >= 0 {
+			end = i
+			break
+		}
+	}
+
+	key, err := unescapeProperty(line[:end])
+	if err != nil {
+		return "", "", err
+	}
+
+	rest := strings.TrimLeft(line[end:], " \t\f")
+
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+
+	val, err := unescapeProperty(rest)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, val, nil
+}
+
+func unescapeProperty(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+
+	var (
+		buf   strings.Builder
+		units []uint16
+	)
+
+	flush := func() {
+		if units != nil {
+			buf.WriteString(string(utf16.Decode(units)))
+			units = nil
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			flush()
+			buf.WriteByte(s[i])
+			continue
+		}
+
+		i++
+
+		if s[i] == 'u' {
+			if i+5 > len(s) {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+
+			u, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+
+			// Surrogate pairs come as two escapes, so collect the units
+			// until something else comes along.
+			units = append(units, uint16(u))
+			i += 4
+
+			continue
+		}
+
+		flush()
+
+		switch s[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'f':
+			buf.WriteByte('\f')
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+
+	flush()
+
+	return buf.String(), nil
+}
+
+// flattenPaths adds every value in val to flat under its dotted key path,
+// with lists indexed by position.
+func flattenPaths(flat map[string]string, path string, val interface{}) {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+
+		return path + "." + k
+	}
+
+	switch v := val.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, sub := range v {
+			flattenPaths(flat, join(k), sub)
+		}
+	case []interface{}:
+		for i, sub := range v {
+			flattenPaths(flat, join(strconv.Itoa(i)), sub)
+		}
+	default:
+		flat[path] = scalarString(v)
+	}
+}
+
+// setPath sets the value at a dotted key path of doc, making the maps on
+// the way as needed.
+func setPath(doc map[string]interface{}, path string, val interface{}) error {
+	parts := strings.Split(path, ".")
+
+	pos := doc
+
+	for _, part := range parts[:len(parts)-1] {
+		switch sub := pos[part].(type) {
+		case nil:
+			m := make(map[string]interface{})
+			pos[part] = m
+			pos = m
+		case map[string]interface{}:
+			pos = sub
+		default:
+			return fmt.Errorf("%s is both a value and a map", path)
+		}
+	}
+
+	name := parts[len(parts)-1]
+
+	if _, ok := pos[name].(map[string]interface{}); ok {
+		return fmt.Errorf("%s is both a value and a map", path)
+	}
+
+	pos[name] = val
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
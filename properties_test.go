@@ -0,0 +1,87 @@
+package datum
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestProperties(t *testing.T) {
+	n := neko.Start(t)
+
+	n.It("renders dotted keys, sorted", func() {
+		doc := map[string]interface{}{
+			"name": "vektra",
+			"db": map[string]interface{}{
+				"host": "localhost",
+				"port": int64(5432),
+			},
+			"hosts": []interface{}{"a", "b"},
+		}
+
+		var buf bytes.Buffer
+
+		renderProperties(&buf, doc)
+
+		expected := "db.host=localhost\ndb.port=5432\nhosts.0=a\nhosts.1=b\nname=vektra\n"
+
+		assert.Equal(t, expected, buf.String())
+	})
+
+	n.It("escapes keys and values", func() {
+		doc := map[string]interface{}{
+			"a key=": " lead\nline\\é",
+		}
+
+		var buf bytes.Buffer
+
+		renderProperties(&buf, doc)
+
+		assert.Equal(t, "a\\ key\\==\\ lead\\nline\\\\\\u00e9\n", buf.String())
+	})
+
+	n.It("parses what it renders", func() {
+		doc := map[string]interface{}{
+			"a key=": " lead\nline\\é😀",
+			"sub": map[string]interface{}{
+				"x:y": "#not a comment",
+			},
+		}
+
+		var buf bytes.Buffer
+
+		renderProperties(&buf, doc)
+
+		parsed, err := parseProperties(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, doc, parsed)
+	})
+
+	n.It("parses comments, separators and continuations", func() {
+		text := "# comment\n! also\n\na = 1\nb: 2\nc 3\nd=long \\\n    value\n"
+
+		doc, err := parseProperties(strings.NewReader(text))
+		require.NoError(t, err)
+
+		expected := map[string]interface{}{
+			"a": "1",
+			"b": "2",
+			"c": "3",
+			"d": "long value",
+		}
+
+		assert.Equal(t, expected, doc)
+	})
+
+	n.It("refuses a key that is both a value and a map", func() {
+		_, err := parseProperties(strings.NewReader("a=1\na.b=2\n"))
+		assert.Error(t, err)
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,229 @@
+package datum
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisStore keeps blobs in Redis, or anything speaking its protocol, so
+// that several datumd instances can share them. Each blob is a string
+// key made of Prefix, the token and the space.
+//
+// Writes from MsgpackBackend go through CompareAndSetBatch, so frontends
+// writing the same space at once retry rather than lose each other's
+// changes.
+type RedisStore struct {
+	Pool   *redis.Pool
+	Prefix string
+}
+
+// NewRedisStore returns a RedisStore using the server at addr.
+func NewRedisStore(addr string) *RedisStore {
+	pool := &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+
+	return &RedisStore{Pool: pool, Prefix: "datum:"}
+}
+
+func (r *RedisStore) Close() error {
+	return r.Pool.Close()
+}
+
+func (r *RedisStore) key(token, space string) string {
+	return r.Prefix + token + "/" + space
+}
+
+func (r *RedisStore) Set(token, space string, val []byte) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", r.key(token, space), val)
+	return err
+}
+
+func (r *RedisStore) Get(token, space string) ([]byte, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	return redisGet(conn, r.key(token, space))
+}
+
+func redisGet(conn redis.Conn, key string) ([]byte, error) {
+	data, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	return data, nil
+}
+
+func (r *RedisStore) Delete(token, space string) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", r.key(token, space))
+	return err
+}
+
+func (r *RedisStore) List(token string) ([]string, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	prefix := r.Prefix + token + "/"
+
+	var (
+		spaces []string
+		cursor = "0"
+	)
+
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", redisGlobEscape(prefix)+"*"))
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+
+		_, err = redis.Scan(reply, &cursor, &keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			spaces = append(spaces, key[len(prefix):])
+		}
+
+		if cursor == "0" {
+			return spaces, nil
+		}
+	}
+}
+
+// redisGlobEscape escapes the characters special to the patterns of SCAN.
+func redisGlobEscape(str string) string {
+	var buf bytes.Buffer
+
+	for _, c := range str {
+		if strings.ContainsRune(`*?[]\`, c) {
+			buf.WriteByte('\\')
+		}
+
+		buf.WriteRune(c)
+	}
+
+	return buf.String()
+}
+
+// CompareAndSet watches the blob while comparing it, so the set fails if
+// another client changes it in the meantime.
+func (r *RedisStore) CompareAndSet(token, space string, old, val []byte) (bool, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	key := r.key(token, space)
+
+	_, err := conn.Do("WATCH", key)
+	if err != nil {
+		return false, err
+	}
+
+	cur, err := redisGet(conn, key)
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+
+	if (cur == nil) != (old == nil) || !bytes.Equal(cur, old) {
+		conn.Do("UNWATCH")
+		return false, nil
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", key, val)
+
+	return redisExec(conn)
+}
+
+// redisExec runs the transaction started on conn, reporting whether it
+// was carried out. It isn't if a watched key was changed, which Redis
+// answers with a nil reply and some of its stand-ins with an empty one.
+func redisExec(conn redis.Conn) (bool, error) {
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return len(replies) > 0, nil
+}
+
+// SetBatch sets the blobs of several spaces of token in one transaction.
+func (r *RedisStore) SetBatch(token string, blobs map[string][]byte) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+
+	for space, val := range blobs {
+		conn.Send("SET", r.key(token, space), val)
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// CompareAndSetBatch watches the blobs in old while comparing them, and
+// sets blobs in one transaction that fails if another client changes
+// them in the meantime.
+func (r *RedisStore) CompareAndSetBatch(token string, old map[string][]byte, blobs map[string][]byte) (bool, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	for space := range old {
+		_, err := conn.Do("WATCH", r.key(token, space))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+	}
+
+	for space, blob := range old {
+		cur, err := redisGet(conn, r.key(token, space))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+
+		if (cur == nil) != (blob == nil) || !bytes.Equal(cur, blob) {
+			conn.Do("UNWATCH")
+			return false, nil
+		}
+	}
+
+	conn.Send("MULTI")
+
+	for space, val := range blobs {
+		conn.Send("SET", r.key(token, space), val)
+	}
+
+	return redisExec(conn)
+}
@@ -0,0 +1,62 @@
+package datum
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestRedisStore(t *testing.T) {
+	n := neko.Start(t)
+
+	var (
+		srv   *miniredis.Miniredis
+		store *RedisStore
+	)
+
+	n.Setup(func() {
+		var err error
+
+		srv, err = miniredis.Run()
+		require.NoError(t, err)
+
+		store = NewRedisStore(srv.Addr())
+	})
+
+	n.Cleanup(func() {
+		store.Close()
+		srv.Close()
+	})
+
+	testBlobStore(t, n, func() BlobStore {
+		return store
+	})
+
+	n.It("keeps blobs under the prefix", func() {
+		err := store.Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		data, err := srv.Get("datum:aabbcc/default")
+		require.NoError(t, err)
+
+		assert.Equal(t, "foo", data)
+	})
+
+	n.It("sets several spaces in one batch", func() {
+		err := store.SetBatch("aabbcc", map[string][]byte{
+			"default": []byte("foo"),
+			"other":   []byte("bar"),
+		})
+		require.NoError(t, err)
+
+		data, err := store.Get("aabbcc", "other")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("bar"), data)
+	})
+
+	n.Meow()
+}
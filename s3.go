@@ -0,0 +1,314 @@
+package datum
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store keeps each blob as an object in an S3 compatible bucket, named
+// by Prefix, the token and the space. Objects are addressed path style,
+// as Endpoint/Bucket/key, which S3 and its stand-ins all accept. Requests
+// are signed with AWS Signature Version 4 if AccessKey is set.
+type S3Store struct {
+	Endpoint string
+	Bucket   string
+	Region   string
+	Prefix   string
+
+	AccessKey string
+	SecretKey string
+
+	Client *http.Client
+}
+
+func NewS3Store(endpoint, bucket, region string) *S3Store {
+	return &S3Store{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Bucket:   bucket,
+		Region:   region,
+		Client:   http.DefaultClient,
+	}
+}
+
+func (s *S3Store) url(token, space string) string {
+	return s.Endpoint + "/" + s3Escape(s.Bucket) + "/" + s3Escape(s.Prefix+token+"/"+space)
+}
+
+// s3Escape percent-encodes a key the way Signature Version 4 expects,
+// leaving only unreserved characters and slashes as they are.
+func s3Escape(key string) string {
+	var buf bytes.Buffer
+
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+
+	return buf.String()
+}
+
+func (s *S3Store) do(method, target string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if s.AccessKey != "" {
+		s.sign(req, body, time.Now())
+	}
+
+	return s.Client.Do(req)
+}
+
+func s3Error(resp *http.Response) error {
+	return fmt.Errorf("s3: %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+func (s *S3Store) Set(token, space string, val []byte) error {
+	resp, err := s.do("PUT", s.url(token, space), val, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (s *S3Store) Get(token, space string) ([]byte, error) {
+	data, _, err := s.get(token, space)
+	return data, err
+}
+
+// get returns an object and its ETag, or nil if there is none.
+func (s *S3Store) get(token, space string) ([]byte, string, error) {
+	resp, err := s.do("GET", s.url(token, space), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return nil, "", nil
+	default:
+		return nil, "", s3Error(resp)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, resp.Header.Get("ETag"), nil
+}
+
+func (s *S3Store) Delete(token, space string) error {
+	resp, err := s.do("DELETE", s.url(token, space), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200, 204, 404:
+		return nil
+	default:
+		return s3Error(resp)
+	}
+}
+
+// s3ListResult is the part of a ListObjectsV2 response that List uses.
+type s3ListResult struct {
+	Keys                  []string `xml:"Contents>Key"`
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Store) List(token string) ([]string, error) {
+	prefix := s.Prefix + token + "/"
+
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+
+	var spaces []string
+
+	for {
+		resp, err := s.do("GET", s.Endpoint+"/"+s3Escape(s.Bucket)+"?"+s3Query(query), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, s3Error(resp)
+		}
+
+		var res s3ListResult
+
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range res.Keys {
+			spaces = append(spaces, strings.TrimPrefix(key, prefix))
+		}
+
+		if !res.IsTruncated {
+			return spaces, nil
+		}
+
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// CompareAndSet puts val on the condition that the object still has the
+// ETag it had when it was compared to old, or that there still is none.
+func (s *S3Store) CompareAndSet(token, space string, old, val []byte) (bool, error) {
+	cur, etag, err := s.get(token, space)
+	if err != nil {
+		return false, err
+	}
+
+	if (cur == nil) != (old == nil) || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+
+	header := make(http.Header)
+
+	if cur == nil {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+
+	resp, err := s.do("PUT", s.url(token, space), val, header)
+	if err != nil {
+		return false, err
+	}
+
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 409, 412:
+		// 409 is returned when a conditional write races another.
+		return false, nil
+	default:
+		return false, s3Error(resp)
+	}
+}
+
+// sign adds a Signature Version 4 Authorization header to req, covering
+// its host, the headers already set, and body.
+func (s *S3Store) sign(req *http.Request, body []byte, t time.Time) {
+	var (
+		sum       = sha256.Sum256(body)
+		payload   = hex.EncodeToString(sum[:])
+		timestamp = t.UTC().Format("20060102T150405Z")
+		date      = timestamp[:8]
+		scope     = date + "/" + s.Region + "/s3/aws4_request"
+	)
+
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var names []string
+
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	var canonical bytes.Buffer
+
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), s3Query(req.URL.Query()))
+
+	for _, k := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", k, headers[k])
+	}
+
+	signed := strings.Join(names, ";")
+
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payload)
+
+	sum = sha256.Sum256(canonical.Bytes())
+
+	toSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign)),
+	))
+}
+
+func s3Query(query url.Values) string {
+	var parts []string
+
+	for k, vals := range query {
+		for _, v := range vals {
+			parts = append(parts, s3EscapeAll(k)+"="+s3EscapeAll(v))
+		}
+	}
+
+	sort.Strings(parts)
+
+	return strings.Join(parts, "&")
+}
+
+// s3EscapeAll is s3Escape for query strings, where slashes are escaped.
+func s3EscapeAll(str string) string {
+	return strings.Replace(s3Escape(str), "/", "%2F", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,214 @@
+package datum
+
+import (
+	"bytes"
+	"database/sql"
+	"time"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS blobs (
+	token      TEXT NOT NULL,
+	space      TEXT NOT NULL,
+	blob       BLOB NOT NULL,
+	revision   INTEGER NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (token, space)
+)`
+
+const sqliteUpsert = `
+INSERT INTO blobs (token, space, blob, revision, updated_at)
+VALUES (?, ?, ?, 1, ?)
+ON CONFLICT (token, space) DO UPDATE SET
+	blob = excluded.blob,
+	revision = blobs.revision + 1,
+	updated_at = excluded.updated_at`
+
+// SQLiteStore keeps blobs in a SQLite database, one row per token and
+// space. Each row counts the times it has been written in revision, and
+// when it last was in updated_at, for those inspecting it with SQL.
+//
+// The caller picks the driver by importing one that registers itself as
+// "sqlite3", such as github.com/mattn/go-sqlite3.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens or creates the database at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only one writer, so share one connection rather than
+	// have them fail with the database locked.
+	db.SetMaxOpenConns(1)
+
+	s, err := NewSQLiteStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewSQLiteStore uses db, creating the blobs table if needed.
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	_, err := db.Exec(sqliteSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStore{db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Set(token, space string, val []byte) error {
+	_, err := s.db.Exec(sqliteUpsert, token, space, val, time.Now())
+	return err
+}
+
+func (s *SQLiteStore) Get(token, space string) ([]byte, error) {
+	return sqliteGet(s.db, token, space)
+}
+
+func (s *SQLiteStore) List(token string) ([]string, error) {
+	rows, err := s.db.Query("SELECT space FROM blobs WHERE token = ?", token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var spaces []string
+
+	for rows.Next() {
+		var space string
+
+		err = rows.Scan(&space)
+		if err != nil {
+			return nil, err
+		}
+
+		spaces = append(spaces, space)
+	}
+
+	return spaces, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(token, space string) error {
+	_, err := s.db.Exec("DELETE FROM blobs WHERE token = ? AND space = ?", token, space)
+	return err
+}
+
+// queryer is what sqliteGet needs from either a DB or a Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func sqliteGet(q queryer, token, space string) ([]byte, error) {
+	var data []byte
+
+	err := q.QueryRow(
+		"SELECT blob FROM blobs WHERE token = ? AND space = ?",
+		token, space,
+	).Scan(&data)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	return data, nil
+}
+
+func (s *SQLiteStore) CompareAndSet(token, space string, old, val []byte) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	cur, err := sqliteGet(tx, token, space)
+	if err != nil {
+		return false, err
+	}
+
+	if (cur == nil) != (old == nil) || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+
+	_, err = tx.Exec(sqliteUpsert, token, space, val, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// SetBatch sets the blobs of several spaces of token in one transaction.
+func (s *SQLiteStore) SetBatch(token string, blobs map[string][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	for space, val := range blobs {
+		_, err = tx.Exec(sqliteUpsert, token, space, val, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CompareAndSetBatch sets the blobs of several spaces of token in one
+// transaction, if those in old are unchanged.
+func (s *SQLiteStore) CompareAndSetBatch(token string, old map[string][]byte, blobs map[string][]byte) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	for space, blob := range old {
+		cur, err := sqliteGet(tx, token, space)
+		if err != nil {
+			return false, err
+		}
+
+		if (cur == nil) != (blob == nil) || !bytes.Equal(cur, blob) {
+			return false, nil
+		}
+	}
+
+	now := time.Now()
+
+	for space, val := range blobs {
+		_, err = tx.Exec(sqliteUpsert, token, space, val, now)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,84 @@
+//go:build cgo
+// +build cgo
+
+package datum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	n := neko.Start(t)
+
+	var store *SQLiteStore
+
+	tmpdir, err := ioutil.TempDir("", "sqlite")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(tmpdir)
+
+	path := filepath.Join(tmpdir, "config.db")
+
+	n.Setup(func() {
+		var err error
+
+		store, err = OpenSQLiteStore(path)
+		require.NoError(t, err)
+	})
+
+	n.Cleanup(func() {
+		store.Close()
+		os.Remove(path)
+	})
+
+	testBlobStore(t, n, func() BlobStore {
+		return store
+	})
+
+	n.It("counts the revisions of a row", func() {
+		err := store.Set("aabbcc", "default", []byte("foo"))
+		require.NoError(t, err)
+
+		ok, err := store.CompareAndSet("aabbcc", "default", []byte("foo"), []byte("bar"))
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		var rev int
+
+		err = store.db.QueryRow(
+			"SELECT revision FROM blobs WHERE token = ? AND space = ?",
+			"aabbcc", "default",
+		).Scan(&rev)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, rev)
+	})
+
+	n.It("sets several spaces in one batch", func() {
+		err := store.SetBatch("aabbcc", map[string][]byte{
+			"default": []byte("foo"),
+			"other":   []byte("bar"),
+		})
+		require.NoError(t, err)
+
+		data, err := store.Get("aabbcc", "default")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("foo"), data)
+
+		data, err = store.Get("aabbcc", "other")
+		require.NoError(t, err)
+
+		assert.Equal(t, []byte("bar"), data)
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,381 @@
+package datum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/bmizerany/pat"
+)
+
+// TemplateError is returned as the body of a 422 when a template can't be
+// rendered.
+type TemplateError struct {
+	Template string `json:"template"`
+
+	// Stage is load, parse or execute.
+	Stage string `json:"stage"`
+
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// templateError turns an error from text/template into a TemplateError,
+// pulling out the position it points at. Those errors look like
+// "template: name:line:col: message", with the column left out by parse
+// errors.
+func templateError(name, stage string, err error) *TemplateError {
+	te := &TemplateError{Template: name, Stage: stage, Message: err.Error()}
+
+	rest := strings.TrimPrefix(err.Error(), "template: "+name+":")
+	if rest == err.Error() {
+		return te
+	}
+
+	for _, pos := range []*int{&te.Line, &te.Column} {
+		colon := strings.IndexByte(rest, ':')
+		if colon < 0 {
+			break
+		}
+
+		n, err := strconv.Atoi(rest[:colon])
+		if err != nil {
+			break
+		}
+
+		*pos = n
+		rest = rest[colon+1:]
+	}
+
+	te.Message = strings.TrimSpace(rest)
+
+	return te
+}
+
+// templatesSpace is the space templates are rendered from unless
+// ?templates names another.
+const templatesSpace = "templates"
+
+// Templates are kept as the top level keys of a space's document, under
+// their whole names, so nginx.conf is one template rather than conf inside
+// nginx. They're read and written through /~space/_templates/name.
+
+// templateIn returns the template called name in doc, the document of a
+// space.
+func templateIn(doc interface{}, name string) interface{} {
+	templates, _ := doc.(map[string]interface{})
+
+	return templates[name]
+}
+
+// lookupTemplate returns the template called name in space.
+func (h *HTTPApi) lookupTemplate(token, space, name string) (interface{}, error) {
+	doc, err := h.be.Get(token, space, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return templateIn(doc, name), nil
+}
+
+func (h *HTTPApi) templates1(w http.ResponseWriter, req *http.Request) {
+	var (
+		token = req.URL.Query().Get(":token")
+		space = req.URL.Query().Get(":space")
+	)
+
+	name := pat.Tail("/:token/~:space/_templates/", req.URL.Path)
+
+	h.template(token, space, name, w, req)
+}
+
+func (h *HTTPApi) templates2(w http.ResponseWriter, req *http.Request) {
+	var (
+		headerToken = req.Header.Get("Config-Token")
+		space       = req.URL.Query().Get(":space")
+	)
+
+	name := pat.Tail("/~:space/_templates/", req.URL.Path)
+
+	h.template(headerToken, space, name, w, req)
+}
+
+// template reads, stores or deletes the template called name in space.
+func (h *HTTPApi) template(token, space, name string, w http.ResponseWriter, req *http.Request) {
+	if name == "" {
+		http.Error(w, "no template given", 400)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		h.getTemplate(token, space, name, w, req)
+	case "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		h.writeTemplate(token, space, name, string(body), w, req)
+	case "DELETE":
+		h.writeTemplate(token, space, name, nil, w, req)
+	}
+}
+
+// getTemplate writes the template called name in space as it's stored,
+// or as it was at the revision asked for.
+func (h *HTTPApi) getTemplate(token, space, name string, w http.ResponseWriter, req *http.Request) {
+	if !h.sync(w, req) {
+		return
+	}
+
+	reader := token
+
+	token, ok := h.authorize(w, token, space, name, CapRead)
+	if !ok {
+		return
+	}
+
+	var (
+		src interface{}
+		err error
+	)
+
+	if rev, pinned, ok := h.pinnedRevision(w, req, token, space); !ok {
+		return
+	} else if pinned {
+		var doc interface{}
+
+		doc, err = h.be.(Historian).GetRevision(token, space, rev, "")
+		src = templateIn(doc, name)
+	} else {
+		src, err = h.lookupTemplate(token, space, name)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.consume(reader)
+
+	if src == nil {
+		http.Error(w, "no such template", 404)
+		return
+	}
+
+	w.Header().Set("ETag", ETag(src))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, scalarString(src))
+}
+
+// writeTemplate stores src as the template called name in space, or
+// deletes it if src is nil. A precondition applies to the template alone:
+// it's checked against the template as read, and the write only goes
+// through if the space hasn't changed since, or else is tried again.
+func (h *HTTPApi) writeTemplate(token, space, name string, src interface{}, w http.ResponseWriter, req *http.Request) {
+	updater, ok := h.be.(Updater)
+	if !ok {
+		notImplemented(w, "templates")
+		return
+	}
+
+	writer := token
+
+	token, ok = h.authorize(w, token, space, name, CapWrite)
+	if !ok {
+		return
+	}
+
+	cond := requestPrecondition(req)
+
+	for {
+		var unchanged *Precondition
+
+		if cond != nil {
+			doc, err := h.be.Get(token, space, "")
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			if !cond.Met(templateIn(doc, name)) {
+				writeError(w, ErrPreconditionFailed)
+				return
+			}
+
+			unchanged = &Precondition{IfNoneMatch: "*"}
+
+			if doc != nil {
+				unchanged = &Precondition{IfMatch: ETag(doc)}
+			}
+		}
+
+		err := updater.Update(writer, token, space, map[string]interface{}{name: src}, true, unchanged)
+		if err == ErrPreconditionFailed && unchanged != nil {
+			continue
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		break
+	}
+
+	h.consume(writer)
+
+	if !h.published {
+		h.hub.notify(token, space)
+	}
+}
+
+func (h *HTTPApi) render1(w http.ResponseWriter, req *http.Request) {
+	var (
+		token = req.URL.Query().Get(":token")
+		space = req.URL.Query().Get(":space")
+	)
+
+	name := pat.Tail("/:token/~:space/_render/", req.URL.Path)
+
+	h.renderTemplate(token, space, name, w, req)
+}
+
+func (h *HTTPApi) render2(w http.ResponseWriter, req *http.Request) {
+	var (
+		headerToken = req.Header.Get("Config-Token")
+		space       = req.URL.Query().Get(":space")
+	)
+
+	name := pat.Tail("/~:space/_render/", req.URL.Path)
+
+	h.renderTemplate(headerToken, space, name, w, req)
+}
+
+// renderTemplate renders the text/template called name in the templates
+// space, or the one given by ?templates, with the document of space as its
+// data. Templates can reach the other spaces of the token with the space
+// and value funcs.
+func (h *HTTPApi) renderTemplate(token, space, name string, w http.ResponseWriter, req *http.Request) {
+	templates := req.URL.Query().Get("templates")
+	if templates == "" {
+		templates = templatesSpace
+	}
+
+	if !checkNames(w, token, space, templates) {
+		return
+	}
+
+	if name == "" {
+		http.Error(w, "no template given", 400)
+		return
+	}
+
+	if !h.sync(w, req) {
+		return
+	}
+
+	reader := token
+
+	token, caps, ok := h.resolve(w, token, CapRead)
+	if !ok {
+		return
+	}
+
+	if !caps.Allows(CapRead, space, "") || !caps.Allows(CapRead, templates, name) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	val, err := h.lookupTemplate(token, templates, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if val == nil {
+		http.Error(w, "no such template", 404)
+		return
+	}
+
+	src, ok := val.(string)
+	if !ok {
+		writeTemplateError(w, &TemplateError{Template: name, Stage: "load", Message: "template is not a string"})
+		return
+	}
+
+	// Cross space lookups go through the same checks as a get would.
+	lookup := func(space, key string) (interface{}, error) {
+		if !ValidName(space) {
+			return nil, fmt.Errorf("invalid space: %s", space)
+		}
+
+		if !caps.Allows(CapRead, space, key) {
+			return nil, fmt.Errorf("access denied to space %s", space)
+		}
+
+		return h.be.Get(token, space, key)
+	}
+
+	funcs := template.FuncMap{
+		"space": func(space string) (interface{}, error) {
+			doc, err := lookup(space, "")
+			if doc == nil && err == nil {
+				doc = map[string]interface{}{}
+			}
+
+			return doc, err
+		},
+		"value": func(space, key string) (interface{}, error) {
+			return lookup(space, key)
+		},
+		"json": func(val interface{}) (string, error) {
+			data, err := json.Marshal(val)
+			return string(data), err
+		},
+	}
+
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(src)
+	if err != nil {
+		writeTemplateError(w, templateError(name, "parse", err))
+		return
+	}
+
+	doc, err := h.be.Get(token, space, "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	var buf bytes.Buffer
+
+	err = tmpl.Execute(&buf, doc)
+	if err != nil {
+		writeTemplateError(w, templateError(name, "execute", err))
+		return
+	}
+
+	h.consume(reader)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func writeTemplateError(w http.ResponseWriter, err *TemplateError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(422)
+
+	json.NewEncoder(w).Encode(err)
+}
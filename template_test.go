@@ -0,0 +1,238 @@
+package datum
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestTemplates(t *testing.T) {
+	n := neko.Start(t)
+
+	var (
+		be *MsgpackBackend
+		h  *HTTPApi
+	)
+
+	n.Setup(func() {
+		be = NewMsgpackBackend(NewMemoryStore())
+		h = NewHTTPApi(UUIDTokenGen(), be)
+
+		require.NoError(t, be.Set("aabbcc", "web", "server.name", "example.com"))
+		require.NoError(t, be.Set("aabbcc", "web", "server.port", int64(8080)))
+		require.NoError(t, be.Set("aabbcc", "db", "host", "db.local"))
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	put := func(path, tmpl, ifMatch string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", path, strings.NewReader(tmpl))
+		require.NoError(t, err)
+
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	store := func(name, tmpl string) {
+		w := put("/aabbcc/~templates/_templates/"+name, tmpl, "")
+
+		require.Equal(t, 200, w.Code, w.Body.String())
+	}
+
+	n.It("renders a template against a space", func() {
+		tmpl := "server {\n  listen {{.server.port}};\n  server_name {{.server.name}};\n}\n"
+
+		store("nginx.conf", tmpl)
+
+		w := get("/aabbcc/~web/_render/nginx.conf")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "server {\n  listen 8080;\n  server_name example.com;\n}\n", w.Body.String())
+	})
+
+	n.It("keeps template names whole", func() {
+		store("nginx.conf", "a")
+		store("app.json", `{"port": {{.server.port}}}`)
+
+		doc, err := be.Get("aabbcc", "templates", "")
+		require.NoError(t, err)
+
+		expected := map[string]interface{}{
+			"nginx.conf": "a",
+			"app.json":   `{"port": {{.server.port}}}`,
+		}
+
+		assert.Equal(t, expected, doc)
+
+		w := get("/aabbcc/~templates/_templates/app.json")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, `{"port": {{.server.port}}}`, w.Body.String())
+
+		w = get("/aabbcc/~web/_render/app.json")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, `{"port": 8080}`, w.Body.String())
+	})
+
+	n.It("deletes a template", func() {
+		store("nginx.conf", "a")
+		store("app.ini", "b")
+
+		req, err := http.NewRequest("DELETE", "/aabbcc/~templates/_templates/nginx.conf", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code)
+
+		doc, err := be.Get("aabbcc", "templates", "")
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]interface{}{"app.ini": "b"}, doc)
+	})
+
+	n.It("leaves a space called templates as any other space", func() {
+		require.NoError(t, be.Set("aabbcc", "templates", "nginx.conf", "a"))
+
+		doc, err := be.Get("aabbcc", "templates", "")
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]interface{}{"nginx": map[string]interface{}{"conf": "a"}}, doc)
+
+		w := get("/aabbcc/~templates/nginx/conf")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "a\n", w.Body.String())
+	})
+
+	n.It("checks preconditions against the template", func() {
+		store("nginx.conf", "a")
+		store("app.json", "b")
+
+		w := get("/aabbcc/~templates/_templates/nginx.conf")
+		require.Equal(t, 200, w.Code)
+
+		tag := w.Header().Get("ETag")
+		require.NotEmpty(t, tag)
+
+		w = put("/aabbcc/~templates/_templates/nginx.conf", "c", tag)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = put("/aabbcc/~templates/_templates/nginx.conf", "d", tag)
+		assert.Equal(t, 412, w.Code)
+
+		w = put("/aabbcc/~templates/_templates/app.json", "e", ETag("b"))
+		assert.Equal(t, 200, w.Code, w.Body.String())
+
+		w = get("/aabbcc/~templates/_templates/nginx.conf")
+		assert.Equal(t, "c", w.Body.String())
+	})
+
+	n.It("reads a template at a revision", func() {
+		store("nginx.conf", "a")
+		store("nginx.conf", "b")
+
+		w := get("/aabbcc/~templates/_templates/nginx.conf?rev=1")
+
+		assert.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, "a", w.Body.String())
+
+		w = get("/aabbcc/~templates/_templates/nginx.conf")
+
+		assert.Equal(t, "b", w.Body.String())
+	})
+
+	n.It("references other spaces of the token", func() {
+		tmpl := `{{(space "db").host}} {{value "db" "host"}} {{json .server.port}}`
+
+		w := put("/aabbcc/~tmpl/_templates/app.conf", tmpl, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = get("/aabbcc/~web/_render/app.conf?templates=tmpl")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "db.local db.local 8080", w.Body.String())
+	})
+
+	n.It("returns 404 for a missing template", func() {
+		w := get("/aabbcc/~web/_render/nope")
+
+		assert.Equal(t, 404, w.Code)
+	})
+
+	n.It("returns parse errors as a 422", func() {
+		store("bad", "line one\n{{.server.name")
+
+		w := get("/aabbcc/~web/_render/bad")
+
+		require.Equal(t, 422, w.Code)
+
+		var te TemplateError
+
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &te))
+
+		assert.Equal(t, "bad", te.Template)
+		assert.Equal(t, "parse", te.Stage)
+		assert.Equal(t, 2, te.Line)
+	})
+
+	n.It("returns missing keys as a 422", func() {
+		store("missing", "{{.server.host}}")
+
+		w := get("/aabbcc/~web/_render/missing")
+
+		require.Equal(t, 422, w.Code)
+
+		var te TemplateError
+
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &te))
+
+		assert.Equal(t, "execute", te.Stage)
+		assert.Equal(t, 1, te.Line)
+		assert.Equal(t, 9, te.Column)
+		assert.Contains(t, te.Message, "host")
+	})
+
+	n.It("keeps access tokens to their spaces", func() {
+		store("app", `{{value "db" "host"}}`)
+
+		entry := accessEntry("aabbcc", &Capabilities{Read: true, Spaces: []string{"web", "templates"}})
+		require.NoError(t, be.Set("_", "access", "a-ddeeff", entry))
+
+		w := get("/a-ddeeff/~web/_render/app")
+
+		require.Equal(t, 422, w.Code)
+		assert.True(t, strings.Contains(w.Body.String(), "access denied"))
+
+		w = get("/a-ddeeff/~db/_render/app")
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	n.Meow()
+}
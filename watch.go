@@ -0,0 +1,390 @@
+package datum
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest a watch may block, whatever the client asks for.
+const maxWait = 10 * time.Minute
+
+// How many changes a stream may fall behind before it's dropped.
+const streamBacklog = 64
+
+// Change describes a key being set in a space, or deleted if Value is
+// nil. Index is the change index of the space after the write.
+type Change struct {
+	Token string
+	Space string
+	Key   string
+	Value interface{}
+	Index uint64
+}
+
+// Publisher is implemented by Backends that report their changes as they
+// are made. HTTPApi uses it to feed watches and streams.
+type Publisher interface {
+	Subscribe(fn func(*Change))
+}
+
+// Indexer is implemented by Backends that count the writes to each space.
+// HTTPApi needs it for watches.
+type Indexer interface {
+	Index(token string, space string) (uint64, error)
+}
+
+// changeHub lets watchers wait for the next change to a space, and
+// streams receive every change to one.
+type changeHub struct {
+	sync.Mutex
+	changed map[string]chan struct{}
+	streams map[string]map[chan *Change]bool
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{
+		changed: make(map[string]chan struct{}),
+		streams: make(map[string]map[chan *Change]bool),
+	}
+}
+
+// changes returns a channel that is closed on the next change to space.
+func (c *changeHub) changes(token, space string) <-chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+
+	k := token + "/" + space
+
+	ch, ok := c.changed[k]
+	if !ok {
+		ch = make(chan struct{})
+		c.changed[k] = ch
+	}
+
+	return ch
+}
+
+func (c *changeHub) notify(token, space string) {
+	c.Lock()
+	defer c.Unlock()
+
+	k := token + "/" + space
+
+	if ch, ok := c.changed[k]; ok {
+		close(ch)
+		delete(c.changed, k)
+	}
+}
+
+func (c *changeHub) publish(change *Change) {
+	c.notify(change.Token, change.Space)
+
+	c.Lock()
+	defer c.Unlock()
+
+	k := change.Token + "/" + change.Space
+
+	for ch := range c.streams[k] {
+		select {
+		case ch <- change:
+		default:
+			// Too far behind, so close it rather than silently skip
+			// changes.
+			delete(c.streams[k], ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel that receives every change to space. It's
+// closed if the receiver falls too far behind.
+func (c *changeHub) subscribe(token, space string) chan *Change {
+	c.Lock()
+	defer c.Unlock()
+
+	k := token + "/" + space
+
+	if c.streams[k] == nil {
+		c.streams[k] = make(map[chan *Change]bool)
+	}
+
+	ch := make(chan *Change, streamBacklog)
+	c.streams[k][ch] = true
+
+	return ch
+}
+
+func (c *changeHub) unsubscribe(token, space string, ch chan *Change) {
+	c.Lock()
+	defer c.Unlock()
+
+	k := token + "/" + space
+
+	if c.streams[k][ch] {
+		delete(c.streams[k], ch)
+		close(ch)
+	}
+
+	if len(c.streams[k]) == 0 {
+		delete(c.streams, k)
+	}
+}
+
+// watch implements long polling for get. If the request has an index, it
+// blocks until the change index of space moves past it, or for a key,
+// until the key's value changes too. Without an index it returns at once
+// so the client can learn the current one. The index is always returned
+// in the Config-Index header. If a response has already been written, or
+// the wait timed out with a 304, false is returned.
+func (h *HTTPApi) watch(w http.ResponseWriter, req *http.Request, token, space, key, wait string) bool {
+	indexer, ok := h.be.(Indexer)
+	if !ok {
+		notImplemented(w, "watches")
+		return false
+	}
+
+	timeout, err := time.ParseDuration(wait)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+
+	if timeout > maxWait {
+		timeout = maxWait
+	}
+
+	var since uint64
+
+	str := req.URL.Query().Get("index")
+	if str != "" {
+		since, err = strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return false
+		}
+	}
+
+	changed := h.hub.changes(token, space)
+
+	idx, err := indexer.Index(token, space)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return false
+	}
+
+	w.Header().Set("Config-Index", strconv.FormatUint(idx, 10))
+
+	if str == "" || idx > since {
+		return true
+	}
+
+	var prev interface{}
+
+	if key != "" {
+		prev, err = h.be.Get(token, space, key)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return false
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-changed:
+		case <-timer.C:
+			w.WriteHeader(304)
+			return false
+		}
+
+		changed = h.hub.changes(token, space)
+
+		idx, err = indexer.Index(token, space)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return false
+		}
+
+		w.Header().Set("Config-Index", strconv.FormatUint(idx, 10))
+
+		if idx <= since {
+			continue
+		}
+
+		if key != "" {
+			val, err := h.be.Get(token, space, key)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return false
+			}
+
+			if reflect.DeepEqual(val, prev) {
+				continue
+			}
+		}
+
+		return true
+	}
+}
+
+// affects reports if a change to path touches the value at key. An empty
+// path is a change to the whole document.
+func affects(path, key string) bool {
+	if key == "" || path == "" || path == key {
+		return true
+	}
+
+	return strings.HasPrefix(path, key+".") || strings.HasPrefix(key, path+".")
+}
+
+// stream sends changes to space, or to key within it, as Server-Sent
+// Events until the client goes away. Each event is named set or delete
+// and carries the change index as its id. The first data line is the key
+// path, and for sets the rest is the new value rendered as get would.
+//
+// A change to the whole document, or to a map holding key, is sent as a
+// change to key alone, and only if it changed the value there. That way
+// a stream never carries anything outside of key.
+func (h *HTTPApi) stream(w http.ResponseWriter, req *http.Request, token, space, key string, codec *Codec) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+
+	changes := h.hub.subscribe(token, space)
+	defer h.hub.unsubscribe(token, space, changes)
+
+	// The value at key as the client knows it. Changes within key leave
+	// it unknown, as they only carry part of it.
+	var (
+		prev  interface{}
+		known bool
+	)
+
+	if key != "" {
+		var err error
+
+		prev, err = h.be.Get(token, space, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		known = true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			if !affects(change.Key, key) {
+				continue
+			}
+
+			switch {
+			case key == "":
+			case change.Key == key:
+				prev, known = change.Value, true
+			case strings.HasPrefix(change.Key, key+"."):
+				known = false
+			default:
+				val := valueAt(change.Value, change.Key, key)
+
+				if known && reflect.DeepEqual(val, prev) {
+					continue
+				}
+
+				prev, known = val, true
+
+				change = &Change{
+					Token: change.Token,
+					Space: change.Space,
+					Key:   key,
+					Value: val,
+					Index: change.Index,
+				}
+			}
+
+			// A change that can't be sent ends the stream, as when the
+			// client has gone away.
+			err := writeEvent(w, change, codec)
+			if err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// valueAt returns the value at key within val, which is the value at
+// path. path must be empty or a prefix of key.
+func valueAt(val interface{}, path, key string) interface{} {
+	rest := key
+
+	if path != "" {
+		rest = strings.TrimPrefix(key, path+".")
+	}
+
+	for _, part := range strings.Split(rest, ".") {
+		doc, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		val = doc[part]
+	}
+
+	return val
+}
+
+// writeEvent writes change to w as a single event, or nothing if its value
+// can't be encoded.
+func writeEvent(w io.Writer, change *Change, codec *Codec) error {
+	event := "set"
+	if change.Value == nil {
+		event = "delete"
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "event: %s\nid: %d\ndata: %s\n", event, change.Index, change.Key)
+
+	if change.Value != nil {
+		var val bytes.Buffer
+
+		err := codec.Encoder.Encode(&val, change.Key, change.Value, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range strings.Split(strings.TrimSuffix(val.String(), "\n"), "\n") {
+			fmt.Fprintf(&buf, "data: %s\n", line)
+		}
+	}
+
+	buf.WriteString("\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
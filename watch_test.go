@@ -0,0 +1,204 @@
+package datum
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestStreams(t *testing.T) {
+	n := neko.Start(t)
+
+	var (
+		be *MsgpackBackend
+		h  *HTTPApi
+	)
+
+	n.Setup(func() {
+		be = NewMsgpackBackend(NewMemoryStore())
+		h = NewHTTPApi(UUIDTokenGen(), be)
+
+		require.NoError(t, be.Set("aabbcc", "def", "public.name", "a"))
+	})
+
+	n.It("only sends a prefix limited token the keys it may read", func() {
+		req, err := http.NewRequest("POST", "/create/access/aabbcc?cap=read&prefix=public", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		require.Equal(t, 200, w.Code)
+
+		token := strings.TrimSpace(w.Body.String())
+
+		req, err = http.NewRequest("GET", "/"+token+"/~def/public?stream=sse", nil)
+		require.NoError(t, err)
+
+		w = httptest.NewRecorder()
+
+		done := make(chan struct{})
+
+		go func() {
+			h.ServeHTTP(w, req)
+			close(done)
+		}()
+
+		var stream chan *Change
+
+		for stream == nil {
+			h.hub.Lock()
+			for ch := range h.hub.streams["aabbcc/def"] {
+				stream = ch
+			}
+			h.hub.Unlock()
+
+			time.Sleep(time.Millisecond)
+		}
+
+		doc := map[string]interface{}{
+			"public": map[string]interface{}{"name": "a"},
+			"secret": map[string]interface{}{"password": "hunter2"},
+		}
+
+		require.NoError(t, be.Update("aabbcc", "aabbcc", "def", doc, false, nil))
+
+		patch := map[string]interface{}{
+			"public": map[string]interface{}{"name": "b"},
+		}
+
+		require.NoError(t, be.Update("aabbcc", "aabbcc", "def", patch, true, nil))
+
+		_, err = be.Rollback("aabbcc", "aabbcc", "def", 2)
+		require.NoError(t, err)
+
+		h.hub.unsubscribe("aabbcc", "def", stream)
+
+		<-done
+
+		expected := "event: set\nid: 3\ndata: public\ndata: {\"name\":\"b\"}\n\n" +
+			"event: set\nid: 4\ndata: public\ndata: {\"name\":\"a\"}\n\n"
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, expected, w.Body.String())
+		assert.NotContains(t, w.Body.String(), "hunter2")
+	})
+
+	n.It("ends a stream once the client can't be written to", func() {
+		req, err := http.NewRequest("GET", "/aabbcc/~def/public?stream=sse", nil)
+		require.NoError(t, err)
+
+		w := &closedWriter{httptest.NewRecorder()}
+
+		done := make(chan struct{})
+
+		go func() {
+			h.ServeHTTP(w, req)
+			close(done)
+		}()
+
+		for {
+			h.hub.Lock()
+			streams := len(h.hub.streams["aabbcc/def"])
+			h.hub.Unlock()
+
+			if streams > 0 {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+
+		require.NoError(t, be.Set("aabbcc", "def", "public.name", "b"))
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("stream kept going")
+		}
+	})
+
+	n.Meow()
+}
+
+// closedWriter is a ResponseWriter whose client has gone away.
+type closedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *closedWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("connection closed")
+}
+
+func TestWatches(t *testing.T) {
+	n := neko.Start(t)
+
+	var (
+		be *MsgpackBackend
+		h  *HTTPApi
+	)
+
+	n.Setup(func() {
+		be = NewMsgpackBackend(NewMemoryStore())
+		h = NewHTTPApi(UUIDTokenGen(), be)
+
+		require.NoError(t, be.Set("aabbcc", "def", "name", "a"))
+	})
+
+	// watch starts a watch of the def space from index and waits for it to
+	// block before returning.
+	watch := func(index string) <-chan *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/aabbcc/~def?wait=5s&index="+index, nil)
+		require.NoError(t, err)
+
+		done := make(chan *httptest.ResponseRecorder, 1)
+
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			done <- w
+		}()
+
+		for {
+			h.hub.Lock()
+			_, waiting := h.hub.changed["aabbcc/def"]
+			h.hub.Unlock()
+
+			if waiting {
+				return done
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	n.It("wakes a watch when its space is deleted and written again", func() {
+		done := watch("1")
+
+		require.NoError(t, be.DeleteSpace("aabbcc", "def", nil))
+
+		w := <-done
+
+		assert.Equal(t, 204, w.Code)
+		assert.Equal(t, "2", w.Header().Get("Config-Index"))
+
+		done = watch("2")
+
+		require.NoError(t, be.Set("aabbcc", "def", "name", "b"))
+
+		w = <-done
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "3", w.Header().Get("Config-Index"))
+	})
+
+	n.Meow()
+}